@@ -1,6 +1,8 @@
 package main
 
-import ()
+import (
+	"time"
+)
 
 //--- Acceptor Role Data structures and Methods ---//
 type PrepareReq struct {
@@ -11,32 +13,110 @@ type PrepareResp struct {
 	Okay     bool
 	Promised Sequence
 	Command  Command
+	Accepted Sequence //Sequence Command was accepted at
+	Fast     bool     //Command was accepted in the fast round rather than by a proposer
+	Voter    Address  //Acceptor that answered, so its vote can be weighed
 }
 
-// Prepare(slot, seq) -> (okay, promised, command):
+// Prepare(slot, seq) -> (okay, promised, command, accepted):
 func (r *Replica) Prepare(receive PrepareReq, reply *PrepareResp) error {
-	r.Mutex.RLock()
-	defer r.Mutex.RUnlock()
 	r.getSlots(receive.Slot)
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	reply.Voter = r.Self
+	if !r.mayVote(receive.N.Address) {
+		reply.Okay = false
+		return nil
+	}
+	if receive.Slot < r.Base {
+		chatf(2, "Prepare: Slot %d has been compacted into a snapshot", receive.Slot)
+		reply.Okay = false
+		//The proposer is behind us - bring it up to date
+		go r.sendSnapshot(receive.N.Address)
+		return nil
+	}
+	r.slot(receive.Slot).Touched = time.Now()
 
-	if r.Slots[receive.Slot].Decided {
-		chatf(2, "Prepare: Slot %d has aleady been decided", r.Slots[receive.Slot].Index)
+	if r.slot(receive.Slot).Decided {
+		chatf(2, "Prepare: Slot %d has aleady been decided", r.slot(receive.Slot).Index)
 	}
-	seqcmp := receive.N.Cmp(r.Slots[receive.Slot].Sequence)
+	promised := r.promised(receive.Slot)
+	seqcmp := receive.N.Cmp(promised)
 	if seqcmp > 0 { //A new highest sequence has been propopsed
-		chatf(2, "Prepare: A new highest number proposal has been received. Replica n: %d, Received n: %d", r.Slots[receive.Slot].Sequence.N, receive.N.N)
-		r.Slots[receive.Slot].Sequence = receive.N
+		chatf(2, "Prepare: A new highest number proposal has been received. Replica n: %d, Received n: %d", promised.N, receive.N.N)
+		r.slot(receive.Slot).Sequence = receive.N
+		r.persist(LogEntry{Kind: LogPromise, Slot: receive.Slot, Sequence: receive.N})
 		reply.Okay = true
-		reply.Promised = r.Slots[receive.Slot].Sequence
-		reply.Command = r.Slots[receive.Slot].Command
+		reply.Promised = r.slot(receive.Slot).Sequence
+		reply.Command = r.slot(receive.Slot).Command
+		reply.Accepted = r.slot(receive.Slot).AcceptedSeq
+		reply.Fast = r.slot(receive.Slot).Fast
 	} else { //Higher sequence has been promised
-		chatf(2, "Prepare: Already promised a higher sequence number. Replica n: %d, Received n: %d", r.Slots[receive.Slot].Sequence.N, receive.N.N)
+		chatf(2, "Prepare: Already promised a higher sequence number. Replica n: %d, Received n: %d", promised.N, receive.N.N)
 		reply.Okay = false
-		reply.Promised = r.Slots[receive.Slot].Sequence
+		reply.Promised = promised
 	}
 	return nil
 }
 
+type PrepareAllReq struct {
+	From int //First slot the promise covers
+	N    Sequence
+}
+type PrepareAllResp struct {
+	Okay     bool
+	Promised Sequence
+	Slots    []Slot  //Slots from 'From' on that have a value accepted or decided
+	Voter    Address //Acceptor that answered, so its vote can be weighed
+	Base     int     //First slot not compacted into the acceptor's snapshot
+}
+
+// PrepareAll(from, seq) -> (okay, promised, slots):
+//A single promise covering every slot from 'from' on, used by a Multi-Paxos leader so
+//that it can skip Prepare for each slot it proposes on afterwards
+func (r *Replica) PrepareAll(receive PrepareAllReq, reply *PrepareAllResp) error {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	reply.Voter = r.Self
+	if !r.mayVote(receive.N.Address) {
+		reply.Okay = false
+		return nil
+	}
+	reply.Base = r.Base
+	//Slots before Base were decided, but nothing here says what - the leader would take
+	//them for holes and fill them with no-ops
+	if receive.From < r.Base {
+		chatf(2, "PrepareAll: Slots from %d have been compacted into a snapshot up to %d", receive.From, r.Base)
+		reply.Okay = false
+		//The leader is behind us - bring it up to date
+		go r.sendSnapshot(receive.N.Address)
+		return nil
+	}
+
+	if receive.N.Cmp(r.Ballot) <= 0 {
+		chatf(2, "PrepareAll: Already promised a higher sequence number to all slots. Replica n: %d, Received n: %d", r.Ballot.N, receive.N.N)
+		reply.Okay = false
+		reply.Promised = r.Ballot
+		return nil
+	}
+	from := receive.From
+	chatf(2, "PrepareAll: Promising n: %d to every slot from %d on", receive.N.N, from)
+	//Never shrink the range an earlier promise covered
+	if r.Ballot.N == 0 || from < r.BallotFrom {
+		r.BallotFrom = from
+	}
+	r.Ballot = receive.N
+	r.persist(LogEntry{Kind: LogBallot, Slot: r.BallotFrom, Sequence: receive.N})
+	for i := from; i < r.Base+len(r.Slots); i++ {
+		if r.slot(i).Accepted || r.slot(i).Decided {
+			reply.Slots = append(reply.Slots, *r.slot(i))
+		}
+	}
+	reply.Okay = true
+	reply.Promised = r.Ballot
+	return nil
+}
+
 type AcceptReq struct {
 	Slot     int
 	Sequence Sequence
@@ -45,25 +125,70 @@ type AcceptReq struct {
 type AcceptResp struct {
 	Okay     bool
 	Promised int
+	Voter    Address //Acceptor that answered, so its vote can be weighed
 }
 
 // Accept(slot, seq, command) -> (okay, promised):
 func (r *Replica) Accept(receive AcceptReq, reply *AcceptResp) error {
-	r.Mutex.RLock()
-	defer r.Mutex.RUnlock()
 	r.getSlots(receive.Slot)
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	reply.Voter = r.Self
+	if !r.mayVote(receive.Sequence.Address) {
+		reply.Okay = false
+		return nil
+	}
+	if receive.Slot < r.Base {
+		chatf(2, "Accept: Slot %d has been compacted into a snapshot", receive.Slot)
+		reply.Okay = false
+		go r.sendSnapshot(receive.Sequence.Address)
+		return nil
+	}
+	r.slot(receive.Slot).Touched = time.Now()
 
-	seqcmp := receive.Sequence.Cmp(r.Slots[receive.Slot].Sequence)
-	if seqcmp <= 0 || r.Slots[receive.Slot].Sequence.N == 0 { //Accept the value
-		r.Slots[receive.Slot].Command = receive.Command
-		r.Slots[receive.Slot].Accepted = true
+	promised := r.promised(receive.Slot)
+	seqcmp := receive.Sequence.Cmp(promised)
+	if seqcmp >= 0 { //Accept the value
+		r.slot(receive.Slot).Sequence = receive.Sequence
+		r.slot(receive.Slot).AcceptedSeq = receive.Sequence
+		r.slot(receive.Slot).Command = receive.Command
+		r.slot(receive.Slot).Accepted = true
+		r.slot(receive.Slot).Fast = false
+		r.persist(LogEntry{Kind: LogAccept, Slot: receive.Slot, Sequence: receive.Sequence, Command: receive.Command})
 		reply.Okay = true
-		reply.Promised = r.Slots[receive.Slot].Sequence.N
-		chatf(2, "Accept: Command accepted. Received n: %d, Replica n: %d", receive.Sequence.N, r.Slots[receive.Slot].Sequence.N)
+		reply.Promised = r.slot(receive.Slot).Sequence.N
+		chatf(2, "Accept: Command accepted. Received n: %d, Replica n: %d", receive.Sequence.N, promised.N)
+		//Mencius: someone used a later slot, so ours before it must not hold up the log
+		if *mencius {
+			go r.skipTo(receive.Slot)
+		}
 	} else { //Don't accept the value because a higher sequence has been promised
 		reply.Okay = false
-		reply.Promised = r.Slots[receive.Slot].Sequence.N
-		chatf(2, "Accept: Command not accepted. Replica had higher sequence value for this slot. Received n: %d, Replica n: %d", receive.Sequence.N, r.Slots[receive.Slot].Sequence.N)
+		reply.Promised = promised.N
+		chatf(2, "Accept: Command not accepted. Replica had higher sequence value for this slot. Received n: %d, Replica n: %d", receive.Sequence.N, promised.N)
 	}
 	return nil
 }
+
+//May this replica vote on a ballot from 'from'? Must hold Mutex.
+func (r *Replica) mayVote(from Address) bool {
+	//Learners and removed replicas do not vote
+	if !r.Member {
+		chatf(2, "Vote: Not a voting member of the cell")
+		return false
+	}
+	//Nobody else gets a vote while our lease to the leader runs
+	if r.leasedToOther(from) {
+		chatf(2, "Vote: The lease is granted to another replica")
+		return false
+	}
+	return true
+}
+
+//Highest sequence promised for slot 'n', counting a leader's promise covering all slots
+func (r *Replica) promised(n int) Sequence {
+	if n >= r.BallotFrom && r.Ballot.Cmp(r.slot(n).Sequence) > 0 {
+		return r.Ballot
+	}
+	return r.slot(n).Sequence
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+//--- Batching several client commands into a single slot ---//
+
+//Command string carried by a batch; the commands themselves are in Command.Batch
+const BatchCommand = "batch"
+
+//Commands waiting to be proposed together, and who to tell once they are decided
+type PendingBatch struct {
+	Commands []Command
+	Done     []chan bool
+}
+
+//Add 'command' to the batch being collected and wait until that batch has been decided.
+//The first command in a batch starts the clock; the batch goes out when the batch delay
+//runs out or the batch is full, whichever comes first.
+func (r *Replica) proposeBatched(command Command) bool {
+	done := make(chan bool, 1)
+
+	r.BatchMutex.Lock()
+	if r.Batch == nil {
+		r.Batch = &PendingBatch{}
+		go func(batch *PendingBatch) {
+			time.Sleep(time.Duration(*batchdelay) * time.Millisecond)
+			r.flushBatch(batch)
+		}(r.Batch)
+	}
+	batch := r.Batch
+	batch.Commands = append(batch.Commands, command)
+	batch.Done = append(batch.Done, done)
+	full := len(batch.Commands) >= *batchsize
+	r.BatchMutex.Unlock()
+
+	if full {
+		r.flushBatch(batch)
+	}
+	return <-done
+}
+
+//Propose 'batch' as one command, unless it has already gone out
+func (r *Replica) flushBatch(batch *PendingBatch) {
+	r.BatchMutex.Lock()
+	if r.Batch != batch {
+		r.BatchMutex.Unlock()
+		return
+	}
+	r.Batch = nil
+	r.BatchMutex.Unlock()
+
+	command := Command{}
+	command.Address = r.Self
+	command.Command = BatchCommand
+	command.Batch = batch.Commands
+	command.Promise = r.sequence(0)
+	command.Tag = rand.Int()
+	command.Key = command.Address.IP + "-" + strconv.Itoa(command.Tag)
+
+	chatf(1, "Batch: Proposing %d commands together", len(batch.Commands))
+	send := ProposeReq{Command: command, Forwarded: true}
+	reply := ProposeResp{}
+	r.Propose(send, &reply)
+	for _, done := range batch.Done {
+		done <- reply.Okay
+	}
+}
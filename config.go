@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+)
+
+//--- Cell membership changes decided through the log ---//
+
+//Commands that change the membership of the cell
+const (
+	AddNode    = "addnode"
+	AddLearner = "addlearner"
+	RemoveNode = "removenode"
+)
+
+//Membership of the cell for every slot from From on
+type Config struct {
+	From     int
+	Cell     []Address
+	Learners []Address //Replicas that are sent decisions but do not vote
+}
+
+//Voting members of the cell right now, this replica among them only if it is one. Cell is
+//only ever replaced, never changed in place, so the slice stays valid after the lock is
+//released. Must hold Mutex.
+func (r *Replica) members() []Address {
+	return r.Cell
+}
+
+//Voting members of the cell right now. Must not hold Mutex.
+func (r *Replica) cell() []Address {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	return r.Cell
+}
+
+//Every voting member of the cell but this replica. Must not hold Mutex.
+func (r *Replica) others() []Address {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	others, _ := without(r.Cell, r.Self.String())
+	return others
+}
+
+//Is this replica a voting member of the cell right now? Must not hold Mutex.
+func (r *Replica) isMember() bool {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	return r.Member
+}
+
+//Membership that the next configuration change will start from
+func (r *Replica) latestConfig() Config {
+	if len(r.Pending) > 0 {
+		return r.Pending[len(r.Pending)-1]
+	}
+	return Config{Cell: r.members(), Learners: r.Learners}
+}
+
+//Apply an addnode/addlearner/removenode command decided in slot 'index'. The new
+//membership only takes effect 'alpha' slots later, so proposals already in flight keep
+//the quorums they started with and every replica switches over at the same slot.
+func (r *Replica) reconfigure(index int, commandTokens []string) string {
+	if len(commandTokens) != 2 {
+		return "Usage: " + commandTokens[0] + " <addr:port>"
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	target := commandTokens[1]
+	latest := r.latestConfig()
+	cell, isMember := without(latest.Cell, target)
+	learners, isLearner := without(latest.Learners, target)
+
+	if commandTokens[0] == AddNode || commandTokens[0] == AddLearner {
+		if isMember {
+			return target + " is already a member of the cell"
+		} else if isLearner && commandTokens[0] == AddLearner {
+			return target + " is already a learner"
+		}
+		address, err := ParseAddress(target)
+		if err != nil {
+			return "Unable to add " + target + ": " + err.Error()
+		}
+		//Adding a learner as a node promotes it to a full acceptor
+		if commandTokens[0] == AddNode {
+			cell = append(cell, address)
+		} else {
+			learners = append(learners, address)
+		}
+	} else if !isMember && !isLearner {
+		return target + " is not a member of the cell"
+	} else if len(cell) == 0 {
+		return "Unable to remove " + target + ": it is the last member of the cell"
+	}
+
+	//Explicit quorum sizes must still intersect, and be reachable, in the new cell
+	if err := checkQuorums(r.totalWeight(cell)); err != nil {
+		return "Unable to " + commandTokens[0] + " " + target + ": " + err.Error()
+	}
+
+	config := Config{From: index + *alpha, Cell: cell, Learners: learners}
+	r.Pending = append(r.Pending, config)
+	chatf(1, "Reconfigure: \"%s\" decided in slot %d, %d members and %d learners from slot %d", commandTokens[0]+" "+target, index, len(cell), len(learners), config.From)
+	return fmt.Sprintf("%s %s decided, cell will have %d members and %d learners from slot %d", commandTokens[0], target, len(cell), len(learners), config.From)
+}
+
+//Copy of 'addresses' without 'target', and whether 'target' was there at all
+func without(addresses []Address, target string) ([]Address, bool) {
+	var rest []Address
+	found := false
+	for _, address := range addresses {
+		if address.String() == target {
+			found = true
+			continue
+		}
+		rest = append(rest, address)
+	}
+	return rest, found
+}
+
+//Switch to the next configuration once every slot before it has been applied. Must hold Mutex.
+func (r *Replica) activateConfig() {
+	for len(r.Pending) > 0 && r.Pending[0].From <= r.Applied+1 {
+		config := r.Pending[0]
+		r.Pending = r.Pending[1:]
+		r.setConfig(config)
+		r.Epoch++
+		chatf(1, "Reconfigure: Cell now has %d members as of slot %d", len(config.Cell), config.From)
+	}
+}
+
+//Make 'config' the membership of the cell. Must hold Mutex.
+func (r *Replica) setConfig(config Config) {
+	wasMember := r.Member
+	_, r.Member = without(config.Cell, r.Self.String())
+	r.Cell = append([]Address(nil), config.Cell...)
+	//Learners keeps this replica too, so the next change starts from the same membership
+	//here as on the voting members
+	r.Learners = append([]Address(nil), config.Learners...)
+	if wasMember && !r.Member {
+		fmt.Println("This replica has been removed from the cell")
+	} else if !wasMember && r.Member {
+		fmt.Println("This replica is now a voting member of the cell")
+	}
+}
+
+//Every other voting member plus every learner - everyone who needs to hear about a
+//decision. Must not hold Mutex.
+func (r *Replica) everyoneElse() []Address {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	others, _ := without(r.Cell, r.Self.String())
+	learners, _ := without(r.Learners, r.Self.String())
+	return append(others, learners...)
+}
+
+//Would a proposal on slot 'index' have to be made under a configuration that is not
+//in effect yet? A change decided in a slot not applied yet could take effect as early as
+//'alpha' slots after the last one applied, so nothing past that is known. Must hold Mutex.
+func (r *Replica) awaitingConfig(index int) bool {
+	if index > r.Applied+*alpha {
+		return true
+	}
+	return len(r.Pending) > 0 && index >= r.Pending[0].From
+}
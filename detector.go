@@ -0,0 +1,187 @@
+package main
+
+import (
+	"time"
+)
+
+//--- Failure detector and leader election ---//
+
+//What this replica believes about another member of the cell
+type Peer struct {
+	Address   Address
+	LastHeard time.Time //Last time a heartbeat went through in either direction
+	Suspected bool
+	Pending   bool      //A heartbeat to this peer has not returned yet
+	Granted   time.Time //When we sent the latest heartbeat this peer granted us the lease on
+}
+
+type HeartbeatReq struct {
+	From  Address
+	Lease bool //The sender is the leader and asks for the lease
+}
+type HeartbeatResp struct {
+	Okay    bool
+	Granted bool //The lease was granted
+	Index   int  //Highest slot accepted or decided here when the lease was granted
+}
+
+//Heartbeat(from, lease) -> (okay, granted, index):
+//Hearing from a peer is as good as the peer answering one of our own heartbeats
+func (r *Replica) Heartbeat(receive HeartbeatReq, reply *HeartbeatResp) error {
+	r.heard(receive.From)
+	if receive.Lease && r.grantLease(receive.From) {
+		reply.Granted = true
+		reply.Index = r.highestAccepted()
+	}
+	reply.Okay = true
+	return nil
+}
+
+//Heartbeat every other member of the cell forever, marking members suspected when they
+//have not been heard from within the suspect timeout
+func (r *Replica) detectFailures() {
+	interval := time.Duration(*heartbeat) * time.Millisecond
+	leased := false
+	for {
+		cell := r.others()
+		//The leader asks for the lease with every heartbeat, itself included
+		sent := time.Now()
+		leasing := *lease > 0 && r.isLeader() && r.grantLease(r.Self)
+		for _, address := range cell {
+			r.PeerMutex.Lock()
+			peer := r.peer(address)
+			pending := peer.Pending
+			peer.Pending = true
+			r.PeerMutex.Unlock()
+			//Don't pile up heartbeats behind one that is stuck connecting
+			if pending {
+				continue
+			}
+			go func(address Address) {
+				send := HeartbeatReq{From: r.Self, Lease: leasing}
+				recv := HeartbeatResp{}
+				err := Call(address.String(), "Replica.Heartbeat", send, &recv)
+				r.PeerMutex.Lock()
+				r.peer(address).Pending = false
+				r.PeerMutex.Unlock()
+				if err == nil && recv.Okay {
+					r.heard(address)
+				}
+				if err == nil && recv.Granted {
+					r.granted(address, sent, recv.Index)
+				}
+			}(address)
+		}
+		time.Sleep(interval)
+
+		leader := r.leader()
+		r.PeerMutex.Lock()
+		for _, peer := range r.Peers {
+			suspected := time.Since(peer.LastHeard) > time.Duration(*suspect)*time.Millisecond
+			if suspected != peer.Suspected {
+				if suspected {
+					chatf(1, "Detector: Suspect %s has failed", peer.Address.String())
+				} else {
+					chatf(1, "Detector: %s is alive again", peer.Address.String())
+				}
+				peer.Suspected = suspected
+			}
+		}
+		r.PeerMutex.Unlock()
+		if elected := r.leader(); elected != leader {
+			chatf(1, "Detector: %s is now the elected leader", elected.String())
+		}
+		if holds := r.holdsLease(); holds != leased {
+			if holds {
+				chatf(1, "Lease: Holding the leader lease")
+			} else {
+				chatf(1, "Lease: The leader lease has lapsed")
+			}
+			leased = holds
+		}
+	}
+}
+
+//Status for 'address', created the first time it is asked for. Must hold PeerMutex.
+func (r *Replica) peer(address Address) *Peer {
+	peer, ok := r.Peers[address.String()]
+	if !ok {
+		//New members get the benefit of the doubt until the suspect timeout passes
+		peer = &Peer{Address: address, LastHeard: time.Now()}
+		r.Peers[address.String()] = peer
+	}
+	return peer
+}
+
+//Record that we just heard from 'address'
+func (r *Replica) heard(address Address) {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	r.peer(address).LastHeard = time.Now()
+}
+
+//Suspect 'address' right away after a call to it failed, instead of waiting for the
+//suspect timeout. It stays suspected until it answers a heartbeat again.
+func (r *Replica) suspectFailed(address Address) {
+	if address.String() == r.Self.String() {
+		return
+	}
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	peer := r.peer(address)
+	if !peer.Suspected {
+		chatf(1, "Detector: Suspect %s has failed", address.String())
+	}
+	peer.Suspected = true
+	peer.LastHeard = time.Now().Add(-time.Duration(*suspect) * time.Millisecond)
+}
+
+//Is 'address' currently believed to be up? This replica always believes it is up itself.
+func (r *Replica) alive(address Address) bool {
+	if address.String() == r.Self.String() {
+		return true
+	}
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	return !r.peer(address).Suspected
+}
+
+//The elected proposer: the member with the lowest address that is not suspected.
+//Every replica with the same view of who is alive picks the same one.
+func (r *Replica) leader() Address {
+	r.Mutex.RLock()
+	cell := r.members()
+	r.Mutex.RUnlock()
+	//A learner that has not heard of any voting member yet has nobody to follow
+	if len(cell) == 0 {
+		return Address{}
+	}
+	leader := cell[0]
+	found := false
+	for _, address := range cell {
+		if r.alive(address) && (!found || address.String() < leader.String()) {
+			leader = address
+			found = true
+		}
+	}
+	return leader
+}
+
+func (r *Replica) isLeader() bool {
+	leader := r.leader()
+	return leader.String() == r.Self.String()
+}
+
+//Wait after losing a round and return the next backoff. The elected leader retries
+//quickly; everyone else waits out a full suspect timeout so that the leader can finish
+//instead of the two preempting each other forever.
+func (r *Replica) backoff(sleepTime int) int {
+	if r.isLeader() {
+		RandLatency(sleepTime)
+		return sleepTime * 2
+	}
+	leader := r.leader()
+	chatf(1, "Propose: %s is the elected leader, waiting before retrying", leader.String())
+	RandLatency(*suspect)
+	return sleepTime
+}
@@ -0,0 +1,985 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//--- Egalitarian Paxos ---//
+
+/*   Commands on different keys commute, so they do not need a place in one global order.
+     In EPaxos mode every replica leads its own instances, and each instance carries the
+     instances it interferes with (same key) as dependencies:
+
+epaxos(v):
+    seq, deps = 1 + highest seq of instances on v's key, every instance on v's key
+    send preAccept(v, seq, deps) to all
+    if preAccept_ok from a fast quorum with nobody adding to seq/deps:
+        commit(v, seq, deps)                      - one round trip
+    else if preAccept_ok from a majority:
+        seq, deps = highest seq and union of deps from the replies
+        send accept(v, seq, deps) to all
+        if accept_ok from a majority:
+            commit(v, seq, deps)
+
+    Committed instances are executed once everything they depend on is committed, by
+    strongly connected component of the dependency graph (dependencies first), and by seq
+    within a component. Membership changes and anything else that is not about a single
+    key still go through the slot log.
+
+    An instance whose leader went quiet for longer than the no-op timeout is recovered by
+    another replica with a higher ballot, or committed as a no-op if nobody saw it.
+*/
+
+const (
+	StatusNone = iota //Only known as somebody's dependency
+	StatusPreAccepted
+	StatusAccepted
+	StatusCommitted
+	StatusExecuted
+)
+
+var statusNames = []string{"none", "pre-accepted", "accepted", "committed", "executed"}
+
+type InstanceID struct {
+	Replica string //Address of the replica that leads the instance
+	N       int
+}
+
+func (id InstanceID) String() string {
+	return fmt.Sprintf("%s.%d", id.Replica, id.N)
+}
+
+//Instances of one command leader that have been executed. A leader numbers its instances
+//one after another, so all but the few executed out of order fold into Below.
+type Executed struct {
+	Below int   //Every instance numbered lower than this has been executed
+	Above []int //Executed instances numbered Below or higher, in order
+}
+
+func (e Executed) has(n int) bool {
+	if n < e.Below {
+		return true
+	}
+	i := sort.SearchInts(e.Above, n)
+	return i < len(e.Above) && e.Above[i] == n
+}
+
+func (e *Executed) add(n int) {
+	if e.has(n) {
+		return
+	}
+	i := sort.SearchInts(e.Above, n)
+	e.Above = append(e.Above, 0)
+	copy(e.Above[i+1:], e.Above[i:])
+	e.Above[i] = n
+	for len(e.Above) > 0 && e.Above[0] == e.Below {
+		e.Below++
+		e.Above = e.Above[1:]
+	}
+}
+
+func (e Executed) copy() Executed {
+	return Executed{Below: e.Below, Above: append([]int(nil), e.Above...)}
+}
+
+//Has every instance executed in 'other' been executed in 'e' too?
+func (e Executed) covers(other Executed) bool {
+	for n := e.Below; n < other.Below; n++ {
+		if !e.has(n) {
+			return false
+		}
+	}
+	for _, n := range other.Above {
+		if !e.has(n) {
+			return false
+		}
+	}
+	return true
+}
+
+//Has every instance executed in 'other' been executed in 'executed' too, for every leader?
+func coversExecuted(executed, other map[string]Executed) bool {
+	for leader, watermark := range other {
+		if !executed[leader].covers(watermark) {
+			return false
+		}
+	}
+	return true
+}
+
+//Number of instances executed
+func (e Executed) count() int {
+	return e.Below + len(e.Above)
+}
+
+//Lowest instance number above every executed one
+func (e Executed) next() int {
+	if len(e.Above) > 0 {
+		return e.Above[len(e.Above)-1] + 1
+	}
+	return e.Below
+}
+
+type Instance struct {
+	ID      InstanceID
+	Command Command
+	Seq     int
+	Deps    []InstanceID
+	Status  int
+	Ballot  Sequence  //Highest ballot promised for this instance
+	VBallot Sequence  //Ballot Seq and Deps were recorded in
+	Touched time.Time //Last time this instance made progress
+}
+
+//Key 'command' reads or writes, or "" if it is not about a single key
+func dataKey(command Command) string {
+	commandTokens := strings.Fields(command.Command)
+	if len(commandTokens) < 2 {
+		return ""
+	}
+	if commandTokens[0] == "put" || commandTokens[0] == "get" || commandTokens[0] == "delete" ||
+		commandTokens[0] == "cas" || commandTokens[0] == "put-if-absent" || commandTokens[0] == "expire" {
+		return commandTokens[1]
+	}
+	return ""
+}
+
+//Whether 'command' is committed by EPaxos here rather than through the slot log. Must not
+//hold Mutex.
+func (r *Replica) leaderless(command Command) bool {
+	return *epaxos && dataKey(command) != "" && r.isMember()
+}
+
+//Everything 'command' has to be ordered against: its key, and its client session, since
+//a session only stays the same on every replica if a client's requests run in one order
+func interference(command Command) []string {
+	var keys []string
+	if key := dataKey(command); key != "" {
+		keys = append(keys, "key "+key)
+	}
+	if command.Client != "" {
+		keys = append(keys, "session "+command.Client)
+	}
+	return keys
+}
+
+//Seq and deps for 'command' in instance 'id', starting from 'seq' and 'deps' and adding
+//every instance this replica knows about that interferes with it. Must hold InstanceMutex.
+func (r *Replica) attributes(id InstanceID, command Command, seq int, deps []InstanceID) (int, []InstanceID) {
+	merged := append([]InstanceID(nil), deps...)
+	for _, key := range interference(command) {
+		for replica, n := range r.KeyInstances[key] {
+			dep := InstanceID{Replica: replica, N: n}
+			if dep != id && !containsInstance(merged, dep) {
+				merged = append(merged, dep)
+			}
+		}
+		if r.KeySeq[key]+1 > seq {
+			seq = r.KeySeq[key] + 1
+		}
+	}
+	sortInstances(merged)
+	return seq, merged
+}
+
+//Remember 'instance' as the latest that interferes with each of its keys from its leader.
+//Must hold InstanceMutex.
+func (r *Replica) noteInstance(instance *Instance) {
+	for _, key := range interference(instance.Command) {
+		if r.KeyInstances[key] == nil {
+			r.KeyInstances[key] = make(map[string]int)
+		}
+		if n, ok := r.KeyInstances[key][instance.ID.Replica]; !ok || instance.ID.N > n {
+			r.KeyInstances[key][instance.ID.Replica] = instance.ID.N
+		}
+		if instance.Seq > r.KeySeq[key] {
+			r.KeySeq[key] = instance.Seq
+		}
+	}
+}
+
+//Instance 'id', created as a placeholder the first time it is asked for. Must hold InstanceMutex.
+func (r *Replica) instance(id InstanceID) *Instance {
+	instance, ok := r.Instances[id]
+	if !ok {
+		instance = &Instance{ID: id, Touched: time.Now()}
+		r.Instances[id] = instance
+	}
+	return instance
+}
+
+//Record 'instance' in the write-ahead log. Called after InstanceMutex is released, since
+//rewriting the log reads every instance.
+func (r *Replica) persistInstance(instance Instance) {
+	r.persist(LogEntry{Kind: LogInstance, Instance: &instance})
+}
+
+func containsInstance(ids []InstanceID, id InstanceID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func sortInstances(ids []InstanceID) {
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Replica != ids[j].Replica {
+			return ids[i].Replica < ids[j].Replica
+		}
+		return ids[i].N < ids[j].N
+	})
+}
+
+func sameDeps(a, b []InstanceID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Size of an EPaxos fast quorum, counting the command leader: F + floor((F+1)/2) for a
+//cell of 2F+1 replicas
+func epaxosFastQuorum(n int) int {
+	f := (n - 1) / 2
+	if f == 0 {
+		return n
+	}
+	return f + (f+1)/2
+}
+
+//--- Acceptor side ---//
+
+type PreAcceptReq struct {
+	ID      InstanceID
+	Ballot  Sequence
+	Command Command
+	Seq     int
+	Deps    []InstanceID
+}
+type PreAcceptResp struct {
+	Okay      bool
+	Ballot    Sequence //Promised ballot, when refusing
+	Seq       int
+	Deps      []InstanceID
+	Committed bool //The instance was already committed with Seq and Deps
+	Executed  bool //The instance was executed into the acceptor's snapshot, which is the only way left to learn it
+	Voter     Address
+}
+
+// PreAccept(id, ballot, command, seq, deps) -> (okay, ballot, seq, deps, committed):
+//Record the instance with its attributes merged with every interfering instance known here
+func (r *Replica) PreAccept(receive PreAcceptReq, reply *PreAcceptResp) error {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	reply.Voter = r.Self
+	if !r.Member {
+		reply.Okay = false
+		return nil
+	}
+	r.InstanceMutex.Lock()
+	if r.executed(receive.ID) {
+		r.InstanceMutex.Unlock()
+		reply.Okay = false
+		reply.Executed = true
+		return nil
+	}
+	instance := r.instance(receive.ID)
+	if receive.Ballot.Cmp(instance.Ballot) < 0 {
+		chatf(2, "PreAccept: Instance %s already promised ballot %d", receive.ID.String(), instance.Ballot.N)
+		reply.Okay = false
+		reply.Ballot = instance.Ballot
+		r.InstanceMutex.Unlock()
+		return nil
+	}
+	if instance.Status >= StatusCommitted {
+		reply.Okay = true
+		reply.Committed = true
+		reply.Seq = instance.Seq
+		reply.Deps = instance.Deps
+		r.InstanceMutex.Unlock()
+		return nil
+	}
+	seq, deps := r.attributes(receive.ID, receive.Command, receive.Seq, receive.Deps)
+	instance.Command = receive.Command
+	instance.Seq = seq
+	instance.Deps = deps
+	instance.Status = StatusPreAccepted
+	instance.Ballot = receive.Ballot
+	instance.VBallot = receive.Ballot
+	instance.Touched = time.Now()
+	r.noteInstance(instance)
+	saved := *instance
+	r.InstanceMutex.Unlock()
+
+	r.persistInstance(saved)
+	chatf(2, "PreAccept: Instance %s \"%s\" seq: %d, deps: %d", receive.ID.String(), receive.Command.Command, seq, len(deps))
+	reply.Okay = true
+	reply.Seq = seq
+	reply.Deps = deps
+	return nil
+}
+
+type AcceptInstanceReq struct {
+	ID      InstanceID
+	Ballot  Sequence
+	Command Command
+	Seq     int
+	Deps    []InstanceID
+}
+type AcceptInstanceResp struct {
+	Okay   bool
+	Ballot Sequence
+	Voter  Address
+}
+
+// AcceptInstance(id, ballot, command, seq, deps) -> (okay, ballot):
+func (r *Replica) AcceptInstance(receive AcceptInstanceReq, reply *AcceptInstanceResp) error {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	reply.Voter = r.Self
+	if !r.Member {
+		reply.Okay = false
+		return nil
+	}
+	r.InstanceMutex.Lock()
+	if r.executed(receive.ID) {
+		r.InstanceMutex.Unlock()
+		reply.Okay = true
+		return nil
+	}
+	instance := r.instance(receive.ID)
+	if receive.Ballot.Cmp(instance.Ballot) < 0 {
+		reply.Okay = false
+		reply.Ballot = instance.Ballot
+		r.InstanceMutex.Unlock()
+		return nil
+	}
+	if instance.Status < StatusCommitted {
+		instance.Command = receive.Command
+		instance.Seq = receive.Seq
+		instance.Deps = receive.Deps
+		instance.Status = StatusAccepted
+	}
+	instance.Ballot = receive.Ballot
+	instance.VBallot = receive.Ballot
+	instance.Touched = time.Now()
+	r.noteInstance(instance)
+	saved := *instance
+	r.InstanceMutex.Unlock()
+
+	r.persistInstance(saved)
+	reply.Okay = true
+	return nil
+}
+
+type CommitInstanceReq struct {
+	ID      InstanceID
+	Command Command
+	Seq     int
+	Deps    []InstanceID
+}
+type CommitInstanceResp struct {
+	Okay bool
+}
+
+// CommitInstance(id, command, seq, deps) -> (okay):
+func (r *Replica) CommitInstance(receive CommitInstanceReq, reply *CommitInstanceResp) error {
+	r.committed(receive.ID, receive.Command, receive.Seq, receive.Deps)
+	reply.Okay = true
+	return nil
+}
+
+//Record that instance 'id' is committed, then execute whatever that unblocks. Must not
+//hold Mutex, since executing can compact the slots.
+func (r *Replica) committed(id InstanceID, command Command, seq int, deps []InstanceID) {
+	r.InstanceMutex.Lock()
+	if r.executed(id) || r.instance(id).Status >= StatusCommitted {
+		r.InstanceMutex.Unlock()
+		return
+	}
+	instance := r.instance(id)
+	instance.Command = command
+	instance.Seq = seq
+	instance.Deps = deps
+	instance.Status = StatusCommitted
+	instance.Touched = time.Now()
+	r.noteInstance(instance)
+	saved := *instance
+	r.InstanceMutex.Unlock()
+
+	r.persistInstance(saved)
+	chatf(1, "EPaxos: Instance %s committed as \"%s\"", id.String(), command.Command)
+	r.executeInstances()
+}
+
+type PrepareInstanceReq struct {
+	ID     InstanceID
+	Ballot Sequence
+}
+type PrepareInstanceResp struct {
+	Okay     bool
+	Ballot   Sequence //Promised ballot, when refusing
+	Instance Instance //What this replica knows about the instance
+	Executed bool     //The instance was executed into the acceptor's snapshot
+	Voter    Address
+}
+
+// PrepareInstance(id, ballot) -> (okay, ballot, instance):
+//Explicit prepare used to take over an instance whose leader went quiet
+func (r *Replica) PrepareInstance(receive PrepareInstanceReq, reply *PrepareInstanceResp) error {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	reply.Voter = r.Self
+	if !r.Member {
+		reply.Okay = false
+		return nil
+	}
+	r.InstanceMutex.Lock()
+	if r.executed(receive.ID) {
+		r.InstanceMutex.Unlock()
+		//Already executed and compacted away - the caller needs our snapshot to learn it
+		reply.Okay = false
+		reply.Executed = true
+		return nil
+	}
+	instance := r.instance(receive.ID)
+	if receive.Ballot.Cmp(instance.Ballot) <= 0 {
+		reply.Okay = false
+		reply.Ballot = instance.Ballot
+		r.InstanceMutex.Unlock()
+		return nil
+	}
+	instance.Ballot = receive.Ballot
+	saved := *instance
+	r.InstanceMutex.Unlock()
+
+	r.persistInstance(saved)
+	reply.Okay = true
+	reply.Instance = saved
+	return nil
+}
+
+//--- Command leader ---//
+
+//Commit 'command' in a new instance led by this replica. Returns once it is committed;
+//the response reaches main() when the instance is executed.
+func (r *Replica) epaxosPropose(command Command) {
+	r.Window <- Nothing{}
+	defer func() { <-r.Window }()
+
+	self := r.Self
+	r.InstanceMutex.Lock()
+	id := InstanceID{Replica: self.String(), N: r.NextInstance}
+	r.NextInstance++
+	seq, deps := r.attributes(id, command, 0, nil)
+	instance := r.instance(id)
+	instance.Command = command
+	instance.Seq = seq
+	instance.Deps = deps
+	instance.Status = StatusPreAccepted
+	instance.Ballot = r.sequence(0)
+	instance.VBallot = instance.Ballot
+	r.noteInstance(instance)
+	saved := *instance
+	r.InstanceMutex.Unlock()
+	r.persistInstance(saved)
+
+	chatf(1, "EPaxos: Proposing \"%s\" as instance %s, seq: %d, deps: %d", command.Command, id.String(), seq, len(deps))
+	r.Mutex.RLock()
+	others, _ := without(r.Cell, r.Self.String())
+	members := len(r.members())
+	r.Mutex.RUnlock()
+	response := make(chan PreAcceptResp, len(others))
+	for _, address := range others {
+		go func(address Address) {
+			send := PreAcceptReq{ID: id, Ballot: saved.Ballot, Command: command, Seq: seq, Deps: deps}
+			recv := PreAcceptResp{}
+			RandLatency()
+			Call(address.String(), "Replica.PreAccept", send, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+
+	//The leader's own pre-accept counts towards both quorums
+	numTrue, agreeing := 1, 1
+	unionSeq, unionDeps := seq, deps
+	var committed *PreAcceptResp
+	var executedBy *Address
+	for i := 0; i < len(others); i++ {
+		preAcceptResp := <-response
+		if preAcceptResp.Executed {
+			executedBy = &preAcceptResp.Voter
+		}
+		if !preAcceptResp.Okay {
+			continue
+		}
+		//Somebody recovered the instance while we were away
+		if preAcceptResp.Committed {
+			committed = &preAcceptResp
+		}
+		numTrue++
+		if preAcceptResp.Seq == seq && sameDeps(preAcceptResp.Deps, deps) {
+			agreeing++
+		}
+		if preAcceptResp.Seq > unionSeq {
+			unionSeq = preAcceptResp.Seq
+		}
+		for _, dep := range preAcceptResp.Deps {
+			if !containsInstance(unionDeps, dep) {
+				unionDeps = append(unionDeps, dep)
+			}
+		}
+	}
+	sortInstances(unionDeps)
+
+	if executedBy != nil {
+		r.catchUpInstances(*executedBy)
+		return
+	}
+	if committed != nil {
+		r.commitInstance(id, command, committed.Seq, committed.Deps)
+		return
+	}
+	if agreeing >= epaxosFastQuorum(members) {
+		chatf(1, "EPaxos: Instance %s committed on the fast path", id.String())
+		r.commitInstance(id, command, seq, deps)
+		return
+	}
+	if numTrue*2 > members && r.acceptInstance(id, saved.Ballot, command, unionSeq, unionDeps) {
+		chatf(1, "EPaxos: Instance %s committed on the slow path, seq: %d, deps: %d", id.String(), unionSeq, len(unionDeps))
+		r.commitInstance(id, command, unionSeq, unionDeps)
+		return
+	}
+
+	//Not enough replicas answered - keep trying to recover the instance ourselves
+	sleepTime := 5 // measured in ms
+	for !r.recoverInstance(id) {
+		sleepTime = r.backoff(sleepTime)
+	}
+}
+
+//Paxos-accept 'seq' and 'deps' for instance 'id' at 'ballot'. Returns true on a majority.
+func (r *Replica) acceptInstance(id InstanceID, ballot Sequence, command Command, seq int, deps []InstanceID) bool {
+	r.Mutex.RLock()
+	cell := r.Cell
+	members := len(r.members())
+	r.Mutex.RUnlock()
+	response := make(chan AcceptInstanceResp, len(cell))
+	for _, address := range cell {
+		go func(address Address) {
+			send := AcceptInstanceReq{ID: id, Ballot: ballot, Command: command, Seq: seq, Deps: deps}
+			recv := AcceptInstanceResp{}
+			RandLatency()
+			Call(address.String(), "Replica.AcceptInstance", send, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+	numTrue := 0
+	for i := 0; i < len(cell); i++ {
+		acceptResp := <-response
+		if acceptResp.Okay {
+			numTrue++
+		} else {
+			r.sawN(acceptResp.Ballot.N)
+		}
+	}
+	return numTrue*2 > members
+}
+
+//Tell every other replica and learner that instance 'id' is committed, then commit it here
+func (r *Replica) commitInstance(id InstanceID, command Command, seq int, deps []InstanceID) {
+	for _, address := range r.everyoneElse() {
+		go func(address Address) {
+			send := CommitInstanceReq{ID: id, Command: command, Seq: seq, Deps: deps}
+			recv := CommitInstanceResp{}
+			RandLatency()
+			Call(address.String(), "Replica.CommitInstance", send, &recv)
+			RandLatency()
+		}(address)
+	}
+	r.committed(id, command, seq, deps)
+}
+
+//Ask 'address', which has executed an instance we have not learned into its snapshot, for
+//that snapshot. Once installed, every instance it covers counts as executed here too.
+func (r *Replica) catchUpInstances(address Address) {
+	r.ApplyMutex.Lock()
+	executed := r.executedInstances()
+	r.Mutex.RLock()
+	request := RequestSnapshotReq{Address: r.Self, Applied: r.Applied, Executed: executed}
+	r.Mutex.RUnlock()
+	r.ApplyMutex.Unlock()
+	chatf(1, "EPaxos: %s has executed instances we missed, asking for its snapshot", address.String())
+	var started bool
+	Call(address.String(), "Replica.RequestSnapshot", request, &started)
+}
+
+//Take over instance 'id' with a higher ballot and get it committed - with whatever its
+//leader may already have gotten chosen, or as a no-op if nobody has seen it. Returns false
+//if a majority did not answer.
+func (r *Replica) recoverInstance(id InstanceID) bool {
+	r.Mutex.RLock()
+	cell := r.Cell
+	members := len(r.members())
+	r.Mutex.RUnlock()
+	r.InstanceMutex.Lock()
+	n := r.instance(id).Ballot.N
+	r.InstanceMutex.Unlock()
+	if highest := r.highestN(); highest > n {
+		n = highest
+	}
+	ballot := r.sequence(n + 1)
+
+	chatf(1, "EPaxos: Recovering instance %s with ballot %d", id.String(), ballot.N)
+	response := make(chan PrepareInstanceResp, len(cell))
+	for _, address := range cell {
+		go func(address Address) {
+			send := PrepareInstanceReq{ID: id, Ballot: ballot}
+			recv := PrepareInstanceResp{}
+			RandLatency()
+			Call(address.String(), "Replica.PrepareInstance", send, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+	var replies []Instance
+	var voters []Address
+	var executedBy *Address
+	for i := 0; i < len(cell); i++ {
+		prepareResp := <-response
+		if prepareResp.Okay {
+			replies = append(replies, prepareResp.Instance)
+			voters = append(voters, prepareResp.Voter)
+		} else if prepareResp.Executed {
+			executedBy = &prepareResp.Voter
+		} else {
+			r.sawN(prepareResp.Ballot.N)
+		}
+	}
+	//Committed and executed elsewhere - its effects can only come from a snapshot now
+	if executedBy != nil {
+		r.catchUpInstances(*executedBy)
+		return true
+	}
+	if len(replies)*2 <= members {
+		chatf(1, "EPaxos: Did not get a majority recovering instance %s", id.String())
+		return false
+	}
+
+	var accepted *Instance
+	preAccepted := make(map[string][]Instance)
+	agreed := make(map[string]int)
+	for i, reply := range replies {
+		if reply.Status >= StatusCommitted {
+			r.commitInstance(id, reply.Command, reply.Seq, reply.Deps)
+			return true
+		} else if reply.Status == StatusAccepted {
+			if accepted == nil || reply.VBallot.Cmp(accepted.VBallot) > 0 {
+				accepted = &replies[i]
+			}
+		} else if reply.Status == StatusPreAccepted {
+			attributes := fmt.Sprintf("%d %v %v", reply.Seq, reply.Deps, reply.VBallot)
+			preAccepted[attributes] = append(preAccepted[attributes], reply)
+			//The leader's own pre-accept says nothing about what the others agreed to
+			if voters[i].String() != id.Replica {
+				agreed[attributes]++
+			}
+		}
+	}
+
+	command, seq, deps := NewNoOp(r.Self), 0, []InstanceID(nil)
+	if accepted != nil {
+		command, seq, deps = accepted.Command, accepted.Seq, accepted.Deps
+	} else if len(preAccepted) > 0 {
+		//Attributes that half the cell pre-accepted in the leader's own ballot might have
+		//been committed on the fast path, so they must be kept. Anything else is merged.
+		chosen := false
+		for attributes, group := range preAccepted {
+			if group[0].VBallot.N == 0 && agreed[attributes] >= members/2 {
+				command, seq, deps = group[0].Command, group[0].Seq, group[0].Deps
+				chosen = true
+			}
+		}
+		if !chosen {
+			for _, group := range preAccepted {
+				for _, reply := range group {
+					command = reply.Command
+					if reply.Seq > seq {
+						seq = reply.Seq
+					}
+					for _, dep := range reply.Deps {
+						if !containsInstance(deps, dep) {
+							deps = append(deps, dep)
+						}
+					}
+				}
+			}
+			sortInstances(deps)
+		}
+	}
+	if !r.acceptInstance(id, ballot, command, seq, deps) {
+		return false
+	}
+	r.commitInstance(id, command, seq, deps)
+	return true
+}
+
+//Watch for instances that have not been committed within the no-op timeout - their
+//leader most likely crashed - and recover them so instances depending on them can execute
+func (r *Replica) recoverAbandoned() {
+	timeout := time.Duration(*nooptimeout) * time.Millisecond
+	for {
+		time.Sleep(timeout / 2)
+		if !r.isMember() {
+			continue
+		}
+		var stuck []InstanceID
+		r.InstanceMutex.Lock()
+		for id, instance := range r.Instances {
+			if instance.Status < StatusCommitted && time.Since(instance.Touched) > timeout {
+				stuck = append(stuck, id)
+			}
+		}
+		r.InstanceMutex.Unlock()
+
+		for _, id := range stuck {
+			chatf(1, "EPaxos: Instance %s has been abandoned", id.String())
+			r.InstanceMutex.Lock()
+			r.instance(id).Touched = time.Now()
+			r.InstanceMutex.Unlock()
+			r.recoverInstance(id)
+		}
+	}
+}
+
+//--- Execution ---//
+
+//Execute every committed instance whose dependencies are all committed, in dependency
+//order. Instances that are still waiting on an uncommitted dependency are left for later.
+func (r *Replica) executeInstances() {
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	r.InstanceMutex.Lock()
+	var ready []InstanceID
+	for id, instance := range r.Instances {
+		if instance.Status == StatusCommitted {
+			ready = append(ready, id)
+		}
+	}
+	sortInstances(ready)
+	graph := &instanceGraph{
+		Replica: r,
+		Index:   make(map[InstanceID]int),
+		Low:     make(map[InstanceID]int),
+		OnStack: make(map[InstanceID]bool),
+		Stuck:   make(map[InstanceID]bool)}
+	for _, id := range ready {
+		if _, visited := graph.Index[id]; !visited && r.Instances[id].Status == StatusCommitted {
+			graph.Blocked = false
+			graph.connect(id)
+			//Whatever is left on the stack depends on something that is not committed
+			if graph.Blocked {
+				for _, stuck := range graph.Stack {
+					graph.Stuck[stuck] = true
+					graph.OnStack[stuck] = false
+				}
+				graph.Stack = nil
+			}
+		}
+	}
+	components := graph.Components
+	r.InstanceMutex.Unlock()
+
+	//Each component is complete and only depends on components before it
+	for _, component := range components {
+		for _, instance := range component {
+			commandResponse := r.applyOnce(-1, instance.Command)
+			chatf(2, "EPaxos: Executed instance %s \"%s\"", instance.ID.String(), instance.Command.Command)
+			//Set a response value for the listener channel listening in main()
+			if !instance.Command.IsNoOp() {
+				r.respond(instance.Command, commandResponse)
+			}
+		}
+		r.Executions += len(component)
+	}
+	if len(components) > 0 && r.snapshotDue() {
+		r.takeSnapshot()
+	}
+}
+
+//Tarjan's strongly connected components over committed instances
+type instanceGraph struct {
+	Replica    *Replica
+	Index      map[InstanceID]int
+	Low        map[InstanceID]int
+	OnStack    map[InstanceID]bool
+	Stack      []InstanceID
+	Next       int
+	Blocked    bool                //Reached an instance that is not committed yet
+	Stuck      map[InstanceID]bool //Instances that lead to one that is not committed yet
+	Components [][]Instance
+}
+
+func (g *instanceGraph) connect(id InstanceID) {
+	r := g.Replica
+	g.Index[id] = g.Next
+	g.Low[id] = g.Next
+	g.Next++
+	g.Stack = append(g.Stack, id)
+	g.OnStack[id] = true
+
+	for _, dep := range r.Instances[id].Deps {
+		if r.executed(dep) {
+			continue
+		}
+		instance := r.instance(dep)
+		if instance.Status == StatusExecuted {
+			continue
+		}
+		if instance.Status < StatusCommitted || g.Stuck[dep] {
+			g.Blocked = true
+			return
+		}
+		if _, visited := g.Index[dep]; !visited {
+			g.connect(dep)
+			if g.Blocked {
+				return
+			}
+			if g.Low[dep] < g.Low[id] {
+				g.Low[id] = g.Low[dep]
+			}
+		} else if g.OnStack[dep] && g.Index[dep] < g.Low[id] {
+			g.Low[id] = g.Index[dep]
+		}
+	}
+
+	if g.Low[id] != g.Index[id] {
+		return
+	}
+	var component []Instance
+	for {
+		top := g.Stack[len(g.Stack)-1]
+		g.Stack = g.Stack[:len(g.Stack)-1]
+		g.OnStack[top] = false
+		r.Instances[top].Status = StatusExecuted
+		component = append(component, *r.Instances[top])
+		if top == id {
+			break
+		}
+	}
+	sort.Slice(component, func(i, j int) bool {
+		if component[i].Seq != component[j].Seq {
+			return component[i].Seq < component[j].Seq
+		}
+		return component[i].ID.String() < component[j].ID.String()
+	})
+	g.Components = append(g.Components, component)
+}
+
+//--- Persistence ---//
+
+//Log entries that reproduce every instance that has not been executed into a snapshot
+//yet. Must not be called with InstanceMutex held.
+func (r *Replica) instanceEntries() []LogEntry {
+	r.InstanceMutex.Lock()
+	defer r.InstanceMutex.Unlock()
+	var entries []LogEntry
+	for _, instance := range r.Instances {
+		if instance.Status == StatusNone {
+			continue
+		}
+		saved := *instance
+		entries = append(entries, LogEntry{Kind: LogInstance, Instance: &saved})
+	}
+	return entries
+}
+
+//Restore an instance from the write-ahead log. Entries for the same instance can land
+//out of order, so an entry never takes an instance back to an earlier state.
+func (r *Replica) replayInstance(saved *Instance) {
+	if r.executed(saved.ID) {
+		return
+	}
+	instance := r.instance(saved.ID)
+	if saved.Ballot.Cmp(instance.Ballot) > 0 {
+		instance.Ballot = saved.Ballot
+	}
+	if saved.Status >= StatusPreAccepted && instance.Status < StatusCommitted &&
+		(saved.Status >= StatusCommitted || saved.VBallot.Cmp(instance.VBallot) > 0 || saved.Status > instance.Status) {
+		instance.Command = saved.Command
+		instance.Seq = saved.Seq
+		instance.Deps = saved.Deps
+		instance.VBallot = saved.VBallot
+		//Executed instances that did not make it into the snapshot run again
+		instance.Status = saved.Status
+		if instance.Status == StatusExecuted {
+			instance.Status = StatusCommitted
+		}
+	}
+	instance.Touched = time.Now()
+	r.noteInstance(instance)
+	if saved.ID.Replica == r.Self.String() && saved.ID.N >= r.NextInstance {
+		r.NextInstance = saved.ID.N + 1
+	}
+}
+
+//Instances whose effects are in the database as of a snapshot, by command leader. Must
+//hold ApplyMutex.
+func (r *Replica) executedInstances() map[string]Executed {
+	r.InstanceMutex.Lock()
+	defer r.InstanceMutex.Unlock()
+	executed := make(map[string]Executed)
+	for leader, watermark := range r.Executed {
+		executed[leader] = watermark.copy()
+	}
+	for id, instance := range r.Instances {
+		if instance.Status == StatusExecuted {
+			watermark := executed[id.Replica]
+			watermark.add(id.N)
+			executed[id.Replica] = watermark
+		}
+	}
+	return executed
+}
+
+//Make 'executed' the instances reflected in the database, after a snapshot has been taken
+//or installed. Executed instances no longer need to be kept in memory.
+func (r *Replica) setExecuted(executed map[string]Executed) {
+	r.InstanceMutex.Lock()
+	defer r.InstanceMutex.Unlock()
+	r.Executed = make(map[string]Executed)
+	for leader, watermark := range executed {
+		r.Executed[leader] = watermark.copy()
+	}
+	for id := range r.Instances {
+		if r.executed(id) {
+			delete(r.Instances, id)
+		}
+	}
+	if next := r.Executed[r.Self.String()].next(); next > r.NextInstance {
+		r.NextInstance = next
+	}
+	//Anything executed here but not in an installed snapshot has to run again
+	for _, instance := range r.Instances {
+		if instance.Status == StatusExecuted {
+			instance.Status = StatusCommitted
+		}
+	}
+}
+
+//Whether instance 'id' has been executed into a snapshot. Must hold InstanceMutex.
+func (r *Replica) executed(id InstanceID) bool {
+	return r.Executed[id.Replica].has(id.N)
+}
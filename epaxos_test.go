@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecutedAdd(t *testing.T) {
+	tests := []struct {
+		name      string
+		add       []int
+		want      Executed
+		wantCount int
+		wantNext  int
+	}{
+		{"nothing executed", nil, Executed{}, 0, 0},
+		{"in order", []int{0, 1, 2}, Executed{Below: 3}, 3, 3},
+		{"out of order", []int{2, 0}, Executed{Below: 1, Above: []int{2}}, 2, 3},
+		{"gap filled", []int{2, 0, 3, 1}, Executed{Below: 4}, 4, 4},
+		{"added twice", []int{0, 0, 5, 5}, Executed{Below: 1, Above: []int{5}}, 2, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executed := Executed{}
+			for _, n := range test.add {
+				executed.add(n)
+			}
+			if len(executed.Above) == 0 {
+				executed.Above = nil
+			}
+			if !reflect.DeepEqual(executed, test.want) {
+				t.Errorf("got %+v, want %+v", executed, test.want)
+			}
+			for _, n := range test.add {
+				if !executed.has(n) {
+					t.Errorf("instance %d was added but is missing", n)
+				}
+			}
+			if got := executed.count(); got != test.wantCount {
+				t.Errorf("count() = %d, want %d", got, test.wantCount)
+			}
+			if got := executed.next(); got != test.wantNext {
+				t.Errorf("next() = %d, want %d", got, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestCoversExecuted(t *testing.T) {
+	tests := []struct {
+		name     string
+		executed map[string]Executed
+		other    map[string]Executed
+		want     bool
+	}{
+		{"both empty", nil, nil, true},
+		{"nothing to cover", map[string]Executed{"a": {Below: 2}}, nil, true},
+		{"lower watermark", map[string]Executed{"a": {Below: 3}}, map[string]Executed{"a": {Below: 2}}, true},
+		{"higher watermark", map[string]Executed{"a": {Below: 2}}, map[string]Executed{"a": {Below: 3}}, false},
+		{"out of order instance covered", map[string]Executed{"a": {Below: 5}}, map[string]Executed{"a": {Below: 1, Above: []int{4}}}, true},
+		{"out of order instance missing", map[string]Executed{"a": {Below: 4}}, map[string]Executed{"a": {Below: 1, Above: []int{4}}}, false},
+		{"watermark filled out of order", map[string]Executed{"a": {Below: 1, Above: []int{1, 2}}}, map[string]Executed{"a": {Below: 3}}, true},
+		{"leader not seen at all", map[string]Executed{"a": {Below: 3}}, map[string]Executed{"b": {Below: 1}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := coversExecuted(test.executed, test.other); got != test.want {
+				t.Errorf("coversExecuted(%v, %v) = %t, want %t", test.executed, test.other, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//--- Key expiry ---//
+
+/*   'put <key> <value> ttl=<duration>' records the TTL alongside the key when the put is
+     applied. Replicas never drop a key on their own clock. Once the TTL has passed on the
+     elected leader's clock, the leader proposes 'expire <key> <tag>', and every replica
+     deletes the key when it applies that slot. The tag names the put that set the TTL, so
+     an expire that loses a race with a later write to the key does nothing.
+*/
+
+type Expiry struct {
+	Tag      int           //Tag of the put that set the TTL
+	TTL      time.Duration //How long after the put the key expires
+	Seen     time.Time     `json:"-"` //When this replica applied the put, by its own clock
+	Proposed time.Time     `json:"-"` //When this replica last proposed expiring the key
+}
+
+//Duration given by a "ttl=<duration>" token
+func ParseTTL(token string) (time.Duration, bool) {
+	if !strings.HasPrefix(token, "ttl=") {
+		return 0, false
+	}
+	ttl, err := time.ParseDuration(strings.TrimPrefix(token, "ttl="))
+	if err != nil || ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+//Key 'key' was written by 'command' with a TTL. Must hold ApplyMutex.
+func (r *Replica) setExpiry(key string, command Command, ttl time.Duration) {
+	r.Expiries[key] = Expiry{Tag: command.Tag, TTL: ttl, Seen: time.Now()}
+}
+
+//Key 'key' was written or deleted without a TTL, so it no longer expires. Must hold ApplyMutex.
+func (r *Replica) clearExpiry(key string) {
+	delete(r.Expiries, key)
+}
+
+//Apply 'expire <key> <tag>', decided in slot 'index'. Must hold ApplyMutex.
+func (r *Replica) expire(index int, key string, tag string) string {
+	expiry, ok := r.Expiries[key]
+	if !ok || strconv.Itoa(expiry.Tag) != tag {
+		return "[" + key + "] was written again and did not expire"
+	}
+	dBaseVal := r.Database[key]
+	r.deleteKey(index, key)
+	return "[" + key + "] => " + dBaseVal + " expired"
+}
+
+//While this replica is the elected leader, propose expiring every key whose TTL has passed
+func (r *Replica) expireKeys() {
+	interval := time.Duration(*heartbeat) * time.Millisecond
+	for {
+		time.Sleep(interval)
+		if !r.isMember() || !r.isLeader() {
+			continue
+		}
+		var commands []string
+		r.ApplyMutex.Lock()
+		for key, expiry := range r.Expiries {
+			if time.Since(expiry.Seen) < expiry.TTL {
+				continue
+			}
+			//Give an earlier proposal time to be decided before trying again
+			if time.Since(expiry.Proposed) < time.Duration(*suspect)*time.Millisecond {
+				continue
+			}
+			expiry.Proposed = time.Now()
+			r.Expiries[key] = expiry
+			commands = append(commands, "expire "+key+" "+strconv.Itoa(expiry.Tag))
+		}
+		r.ApplyMutex.Unlock()
+
+		for _, command := range commands {
+			chatf(1, "Expiry: Proposing \"%s\"", command)
+			go func(command string) {
+				send := ProposeReq{Command: Command{Command: command, Address: r.Self, Promise: r.sequence(0), Tag: rand.Int()}}
+				recv := ProposeResp{}
+				r.Propose(send, &recv)
+			}(command)
+		}
+	}
+}
+
+//Make 'expiries' the TTLs in effect, after a snapshot has been loaded or installed. Their
+//clocks start over, so a key can outlive its TTL by the time since the snapshot was taken.
+func (r *Replica) setExpiries(expiries map[string]Expiry) {
+	r.Expiries = make(map[string]Expiry)
+	for key, expiry := range expiries {
+		expiry.Seen = time.Now()
+		r.Expiries[key] = expiry
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"time"
+)
+
+//--- Fast Paxos ---//
+
+/*   Every slot starts out in an implicit fast round (ballot 0) that any replica may send
+     values to directly, without a Prepare and without going through the leader:
+
+fast(v):
+    choose a slot s nobody has accepted a value in yet
+    send fastAccept(s, v) to all
+    if fastAccept_ok from a fast quorum:
+        send decided(s, v) to all
+    else:
+        collision - run the classic proposer(v), whose Prepare recovers slot s
+
+    A fast quorum is large enough that any two of them and any phase 1 quorum share an
+    acceptor, so when recovering a slot only one fast value can have the most votes among
+    the Prepare replies if it might have been chosen.
+*/
+
+type FastAcceptReq struct {
+	Slot    int
+	Command Command
+}
+type FastAcceptResp struct {
+	Okay    bool
+	Command Command //Value already accepted in the slot, when it is not ours
+	Voter   Address //Acceptor that answered, so its vote can be weighed
+}
+
+// FastAccept(slot, command) -> (okay, command):
+//Accept 'command' in the fast round of 'slot', as long as no classic proposer has
+//prepared the slot and nothing else was fast accepted there first
+func (r *Replica) FastAccept(receive FastAcceptReq, reply *FastAcceptResp) error {
+	r.getSlots(receive.Slot)
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	reply.Voter = r.Self
+	if !r.mayVote(receive.Command.Address) {
+		reply.Okay = false
+		return nil
+	}
+	if receive.Slot < r.Base {
+		chatf(2, "FastAccept: Slot %d has been compacted into a snapshot", receive.Slot)
+		reply.Okay = false
+		go r.sendSnapshot(receive.Command.Address)
+		return nil
+	}
+	slot := r.slot(receive.Slot)
+	slot.Touched = time.Now()
+
+	if slot.Decided || slot.Accepted {
+		chatf(2, "FastAccept: Slot %d already holds \"%s\"", receive.Slot, slot.Command.Command)
+		reply.Okay = slot.Command.Tag == receive.Command.Tag
+		reply.Command = slot.Command
+		return nil
+	}
+	if r.promised(receive.Slot).N > 0 {
+		chatf(2, "FastAccept: Slot %d has left the fast round, promised n: %d", receive.Slot, r.promised(receive.Slot).N)
+		reply.Okay = false
+		return nil
+	}
+	slot.Command = receive.Command
+	slot.Accepted = true
+	slot.Fast = true
+	r.persist(LogEntry{Kind: LogFastAccept, Slot: receive.Slot, Command: receive.Command})
+	reply.Okay = true
+	reply.Command = receive.Command
+	chatf(2, "FastAccept: Command \"%s\" accepted on slot %d", receive.Command.Command, receive.Slot)
+	return nil
+}
+
+//Try to get 'command' decided in a fast round. Returns false on a collision or when a
+//fast quorum could not be reached, in which case the command has to go the classic way.
+func (r *Replica) fastPropose(command Command) bool {
+	r.Window <- Nothing{}
+	defer func() { <-r.Window }()
+
+	index := r.reserveFastSlot()
+	defer r.releaseSlot(index)
+
+	chatf(1, "Fast: Proposing \"%s\" on slot #: %d", command.Command, index)
+	cell := r.cell()
+	response := make(chan FastAcceptResp, len(cell))
+	for _, address := range cell {
+		go func(address Address) {
+			send := FastAcceptReq{Slot: index, Command: command}
+			recv := FastAcceptResp{}
+			RandLatency()
+			Call(address.String(), "Replica.FastAccept", send, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+	votes := 0
+	for i := 0; i < len(cell); i++ {
+		fastResp := <-response
+		if fastResp.Okay {
+			votes += r.weight(fastResp.Voter)
+		} else if fastResp.Command.Command != "" {
+			chatf(1, "Fast: Collision on slot %d with \"%s\"", index, fastResp.Command.Command)
+		}
+	}
+	if !r.reachedFast(votes) {
+		chatf(1, "Fast: No fast quorum on slot %d, falling back to a classic round", index)
+		return false
+	}
+
+	//send decided(v) to everyone else, then record it locally
+	r.broadcastDecide(index, command)
+	r.learned(index, command)
+	return true
+}
+
+//Reserve the first slot that this replica has not seen any value for yet - a slot some
+//other replica has already fast accepted into would only end in a collision
+func (r *Replica) reserveFastSlot() int {
+	index := r.reserveSlot(0)
+	for {
+		r.Mutex.RLock()
+		busy := index < r.Base+len(r.Slots) && (r.slot(index).Accepted || r.promised(index).N > 0)
+		r.Mutex.RUnlock()
+		if !busy {
+			return index
+		}
+		next := r.reserveSlot(index + 1)
+		r.releaseSlot(index)
+		index = next
+	}
+}
+
+//Fast round values reported by Prepare for one slot, weighed by the votes behind them
+type FastVotes struct {
+	Votes    map[int]int //Vote weight behind each command, by tag
+	Commands map[int]Command
+}
+
+func NewFastVotes() *FastVotes {
+	return &FastVotes{Votes: make(map[int]int), Commands: make(map[int]Command)}
+}
+
+func (f *FastVotes) Add(command Command, weight int) {
+	f.Votes[command.Tag] += weight
+	f.Commands[command.Tag] = command
+}
+
+//The fast value with the most votes. If any fast value could have been chosen it is
+//this one, so a recovering proposer has to propose it.
+func (f *FastVotes) Choose() (Command, bool) {
+	best, found := Command{}, false
+	for tag, votes := range f.Votes {
+		if !found || votes > f.Votes[best.Tag] {
+			best = f.Commands[tag]
+			found = true
+		}
+	}
+	return best, found
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -48,19 +47,16 @@ func Call(address string, method string, request interface{}, reply interface{})
 		return err
 	}
 
-	if err = client.Call(method, request, reply); err != nil {
-		log.Fatalf("Error calling "+method+": %v", err)
-	}
-	client.Close()
-	return err
+	defer client.Close()
+	return client.Call(method, request, reply)
 }
 
 func PrintPrompt(args ...string) {
 	prefix := "paxos> "
 	if len(args) == 0 {
-		fmt.Printf(prefix)
+		fmt.Print(prefix)
 	} else if len(args) == 1 {
-		fmt.Printf(prefix + " " + args[0] + "\n")
+		fmt.Print(prefix + " " + args[0] + "\n")
 	} else {
 		fmt.Printf(prefix+" "+args[0]+"\n", args[1:])
 	}
@@ -87,21 +83,3 @@ func chatf(level int, format string, args ...interface{}) {
 		fmt.Printf(format+"\n", args...)
 	}
 }
-
-func everySlotDecided(slots []Slot, n int) bool {
-	if n == 1 {
-		return true
-	}
-	for key, value := range slots {
-		if key == 0 {
-			continue
-		}
-		if key >= n {
-			break
-		}
-		if !value.Decided {
-			return false
-		}
-	}
-	return true
-}
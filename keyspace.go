@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//--- Ordered key space ---//
+
+/*   Database is a map, so Keys keeps every key in it in sorted order alongside. setKey and
+     deleteKey keep the two in step, which lets scan and list walk a range of keys in order
+     without sorting the whole database each time.
+
+     scan and list go through the slot log, which EPaxos commits single-key commands
+     outside of, so they are refused under -epaxos. stale-scan and stale-list still work.
+*/
+
+//Add 'key' to Keys if it is not there yet. Must hold ApplyMutex.
+func (r *Replica) indexKey(key string) {
+	i := sort.SearchStrings(r.Keys, key)
+	if i < len(r.Keys) && r.Keys[i] == key {
+		return
+	}
+	r.Keys = append(r.Keys, "")
+	copy(r.Keys[i+1:], r.Keys[i:])
+	r.Keys[i] = key
+}
+
+//Remove 'key' from Keys. Must hold ApplyMutex.
+func (r *Replica) unindexKey(key string) {
+	i := sort.SearchStrings(r.Keys, key)
+	if i < len(r.Keys) && r.Keys[i] == key {
+		r.Keys = append(r.Keys[:i], r.Keys[i+1:]...)
+	}
+}
+
+//Rebuild Keys from Database, after a snapshot has been loaded or installed
+func (r *Replica) indexKeys() {
+	r.Keys = make([]string, 0, len(r.Database))
+	for key := range r.Database {
+		r.Keys = append(r.Keys, key)
+	}
+	sort.Strings(r.Keys)
+}
+
+//Keys from 'start' up to but not including 'end', in order, at most 'limit' of them if
+//'limit' is above 0, formatted the way 'get' answers. Must hold ApplyMutex.
+func (r *Replica) scan(start string, end string, limit int) string {
+	var lines []string
+	for i := sort.SearchStrings(r.Keys, start); i < len(r.Keys) && r.Keys[i] < end; i++ {
+		if limit > 0 && len(lines) == limit {
+			break
+		}
+		lines = append(lines, "["+r.Keys[i]+"] => "+r.Database[r.Keys[i]])
+	}
+	return scanResponse(lines)
+}
+
+//Keys that start with 'prefix', in order. Must hold ApplyMutex.
+func (r *Replica) list(prefix string) string {
+	var lines []string
+	for i := sort.SearchStrings(r.Keys, prefix); i < len(r.Keys) && strings.HasPrefix(r.Keys[i], prefix); i++ {
+		lines = append(lines, "["+r.Keys[i]+"] => "+r.Database[r.Keys[i]])
+	}
+	return scanResponse(lines)
+}
+
+func scanResponse(lines []string) string {
+	if len(lines) == 0 {
+		return "No keys found"
+	}
+	return strings.Join(lines, "\n") + "\n# Keys found: " + strconv.Itoa(len(lines))
+}
+
+//Apply 'scan <start> <end> [limit]' or 'list <prefix>' from 'commandTokens'. Must hold ApplyMutex.
+func (r *Replica) applyScan(commandTokens []string) string {
+	if commandTokens[0] == "list" {
+		return r.list(commandTokens[1])
+	}
+	limit := 0
+	if len(commandTokens) == 4 {
+		limit, _ = strconv.Atoi(commandTokens[3])
+	}
+	return r.scan(commandTokens[1], commandTokens[2], limit)
+}
+
+//Answer 'stale-scan' or 'stale-list' from the local database, which may be out of date
+func (r *Replica) scanLocal(commandTokens []string) string {
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	commandTokens[0] = strings.TrimPrefix(commandTokens[0], "stale-")
+	return r.applyScan(commandTokens)
+}
@@ -0,0 +1,173 @@
+package main
+
+//--- Multi-Paxos distinguished leader ---//
+
+/*   Once a replica wins PrepareAll from a phase 1 quorum it is the leader for every slot from
+     that point on, and only needs the Accept phase for each new command:
+
+leader(v):
+    if not leader:
+        choose n higher than any n seen so far
+        send prepareAll(n, first unapplied slot) to all servers including self
+        if prepareAll_ok(n) from a phase 1 quorum:
+            finish any slot the replies show a value accepted in, no-op any holes
+            leader = true
+    choose the next free slot s
+    send accept(s, n, v) to all
+    if accept_ok(n) from a phase 2 quorum:
+        send decided(s, v) to all
+    else:
+        leader = false   (another proposer preempted us)
+*/
+
+//Propose 'command' through the Multi-Paxos leader path. Returns false if this replica
+//could not become leader or was preempted, in which case the caller should retry.
+//Several of these may run at once, each on its own slot.
+func (r *Replica) leaderPropose(command Command) bool {
+	r.LeaderMutex.Lock()
+	//A PrepareAll from before a membership change was only answered by the old members
+	if r.Leading && r.LeaderEpoch != r.Epoch {
+		chatf(1, "Leader: Membership changed, sending PrepareAll again")
+		r.Leading = false
+	}
+	if !r.Leading && !r.becomeLeader() {
+		r.LeaderMutex.Unlock()
+		return false
+	}
+	//Skip past anything that was decided without us or is already in flight
+	index := r.reserveSlot(r.NextSlot)
+	r.NextSlot = index + 1
+	ballot := r.LeaderBallot
+	r.LeaderMutex.Unlock()
+	defer r.releaseSlot(index)
+
+	chatf(1, "Leader: Proposing \"%s\" on slot #: %d", command.Command, index)
+	if !r.leaderAccept(index, ballot, command) {
+		chatf(1, "Leader: Preempted on slot %d, stepping down", index)
+		r.LeaderMutex.Lock()
+		if r.LeaderBallot == ballot {
+			r.Leading = false
+		}
+		r.LeaderMutex.Unlock()
+		return false
+	}
+	return true
+}
+
+//Send PrepareAll for every slot from the first one we have not applied. On success,
+//finish off any slot where the replies show a value was already accepted.
+func (r *Replica) becomeLeader() bool {
+	r.Mutex.RLock()
+	from := r.Applied + 1
+	epoch := r.Epoch
+	n := r.highestN()
+	if r.Ballot.N > n {
+		n = r.Ballot.N
+	}
+	r.Mutex.RUnlock()
+	n++
+	ballot := r.sequence(n)
+
+	chatf(1, "Leader: Sending PrepareAll n: %d from slot %d", n, from)
+	cell := r.cell()
+	response := make(chan PrepareAllResp, len(cell))
+	for _, address := range cell {
+		go func(address Address) {
+			send := PrepareAllReq{From: from, N: ballot}
+			recv := PrepareAllResp{}
+			RandLatency()
+			Call(address.String(), "Replica.PrepareAll", send, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+
+	numTrue := 0
+	next := from
+	accepted := make(map[int]Slot)
+	for i := 0; i < len(cell); i++ {
+		prepareResp := <-response
+		r.sawN(prepareResp.Promised.N)
+		if !prepareResp.Okay {
+			continue
+		}
+		numTrue += r.weight(prepareResp.Voter)
+		//v' = va with highest na for every slot
+		for _, slot := range prepareResp.Slots {
+			previous, ok := accepted[slot.Index]
+			if !ok || slot.Decided || (!previous.Decided && slot.AcceptedSeq.Cmp(previous.AcceptedSeq) > 0) {
+				accepted[slot.Index] = slot
+			}
+			if slot.Index >= next {
+				next = slot.Index + 1
+			}
+		}
+	}
+	if !r.reached(Phase1, numTrue) {
+		chatf(1, "Leader: Did not get a quorum of 'true' votes from PrepareAll")
+		return false
+	}
+	chatf(1, "Leader: Got a quorum of 'true' votes from PrepareAll, now leading with n: %d", n)
+	r.Leading = true
+	r.LeaderBallot = ballot
+	r.LeaderEpoch = epoch
+
+	//Re-propose whatever a previous leader may have gotten accepted, and fill the holes
+	for index := from; index < next; index++ {
+		slot, ok := accepted[index]
+		command := NewNoOp(r.Self)
+		if ok {
+			command = slot.Command
+		}
+		r.Mutex.RLock()
+		decided := index < r.Base || (index < r.Base+len(r.Slots) && r.slot(index).Decided)
+		r.Mutex.RUnlock()
+		if decided {
+			continue
+		}
+		if ok && slot.Decided {
+			r.learned(index, command)
+			continue
+		}
+		if !r.leaderAccept(index, ballot, command) {
+			r.Leading = false
+			return false
+		}
+	}
+	r.NextSlot = next
+	return true
+}
+
+//Phase 2 only: send accept(index, ballot, command) to all, and on a phase 2 quorum send
+//decided(index, command) to all. Returns false if we have been preempted.
+func (r *Replica) leaderAccept(index int, ballot Sequence, command Command) bool {
+	cell := r.cell()
+	acceptResponse := make(chan AcceptResp, len(cell))
+	r.proposing(index)
+	for _, address := range cell {
+		go func(address Address) {
+			send := AcceptReq{Slot: index, Sequence: ballot, Command: command}
+			recv := AcceptResp{}
+			RandLatency()
+			Call(address.String(), "Replica.Accept", send, &recv)
+			RandLatency()
+			acceptResponse <- recv
+		}(address)
+	}
+	numTrue := 0
+	for i := 0; i < len(cell); i++ {
+		acceptResp := <-acceptResponse
+		if acceptResp.Okay {
+			numTrue += r.weight(acceptResp.Voter)
+		}
+		r.sawN(acceptResp.Promised)
+	}
+	if !r.reached(Phase2, numTrue) {
+		return false
+	}
+
+	//send decided(v) to everyone else, then record it locally
+	r.broadcastDecide(index, command)
+	r.learned(index, command)
+	return true
+}
@@ -6,6 +6,10 @@ import (
 )
 
 //--- Learner Role Data structures and Methods ---//
+
+//How long a missing slot may stay missing before we go looking for it
+const CatchupDelay = time.Second
+
 type DecideReq struct {
 	Slot    int
 	Command Command
@@ -16,48 +20,271 @@ type DecideResp struct {
 
 //Decide(slot, command)
 func (r *Replica) Decide(receive DecideReq, reply *DecideResp) error {
+	r.getSlots(receive.Slot)
 	r.Mutex.RLock()
-	defer r.Mutex.RUnlock()
+	if receive.Slot < r.Base {
+		r.Mutex.RUnlock()
+		chatf(2, "Decide: Slot %d is already covered by the snapshot", receive.Slot)
+		reply.Success = false
+		return nil
+	}
 
-	if r.Slots[receive.Slot].Decided && (r.Slots[receive.Slot].Command.Command != receive.Command.Command) {
+	if r.slot(receive.Slot).Decided && (r.slot(receive.Slot).Command.Command != receive.Command.Command) {
 		panic("Decide: Value has already been decided and it is different from received value")
 	}
 
-	if r.Slots[receive.Slot].Decided {
+	if r.slot(receive.Slot).Decided {
+		r.Mutex.RUnlock()
 		chatf(2, "Decide: This slot has already been decided")
 		reply.Success = false
+		return nil
 	}
+	r.Mutex.RUnlock()
 
-	r.Slots[receive.Slot].Decided = true
+	r.learned(receive.Slot, receive.Command)
 	chatf(2, "Decide: \"%s\" has been decided.", receive.Command.Command)
+	if *mencius {
+		go r.skipTo(receive.Slot)
+	}
+
+	//An earlier slot is still missing - go find out what it was
+	r.Mutex.RLock()
+	applied := r.Applied
+	r.Mutex.RUnlock()
+	if applied < receive.Slot {
+		go r.fillGaps(receive.Slot)
+	}
+	reply.Success = true
+	return nil
+}
+
+//Send decided(index, command) to every other member and learner without waiting for them
+func (r *Replica) broadcastDecide(index int, command Command) {
+	for _, address := range r.everyoneElse() {
+		go func(address Address) {
+			send := DecideReq{index, command}
+			recv := DecideResp{}
+			RandLatency()
+			Call(address.String(), "Replica.Decide", send, &recv)
+			RandLatency()
+		}(address)
+	}
+}
+
+//Record that 'command' was decided in slot 'n', then apply it along with any decided
+//slots that were waiting on it. Must not hold Mutex, since applying can compact the slots.
+func (r *Replica) learned(n int, command Command) {
+	r.getSlots(n)
+	r.Mutex.Lock()
+	if n < r.Base || r.slot(n).Decided {
+		r.Mutex.Unlock()
+		return
+	}
+	r.persist(LogEntry{Kind: LogDecide, Slot: n, Command: command})
+	r.slot(n).Command = command
+	r.slot(n).Decided = true
+	r.Mutex.Unlock()
+	r.applyDecided()
+}
+
+type LearnReq struct {
+	Slot int
+}
+type LearnResp struct {
+	Decided   bool
+	Compacted bool //Slot is only available as part of a snapshot
+	Command   Command
+}
+
+//Learn(slot) -> (decided, compacted, command):
+func (r *Replica) Learn(receive LearnReq, reply *LearnResp) error {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	if receive.Slot < r.Base {
+		reply.Compacted = true
+	} else if receive.Slot < r.Base+len(r.Slots) && r.slot(receive.Slot).Decided {
+		reply.Decided = true
+		reply.Command = r.slot(receive.Slot).Command
+	}
+	return nil
+}
+
+//Fill every undecided slot before slot 'n' so that 'n' can be applied. Each missing slot is
+//learned from a peer that knows it, or failing that, decided with a no-op.
+func (r *Replica) fillGaps(n int) {
+	//Only one catch-up at a time; it keeps going until everything before 'n' is applied
+	if !r.CatchupMutex.TryLock() {
+		return
+	}
+	defer r.CatchupMutex.Unlock()
 
-	//First time this slot has been decided - can decision be applied?
-	for !everySlotDecided(r.Slots, receive.Slot) {
-		time.Sleep(time.Second)
+	//Give a Decide that is merely late a chance to arrive first
+	time.Sleep(CatchupDelay)
+	for {
+		r.Mutex.RLock()
+		missing := r.Applied + 1
+		r.Mutex.RUnlock()
+		if missing >= n {
+			return
+		}
+
+		chatf(1, "Catchup: Slot %d is missing, asking peers", missing)
+		command, decided := r.learn(missing)
+		if !decided && *mencius && r.isMember() {
+			r.menciusFill(missing)
+			continue
+		}
+		if !decided && !r.isMember() {
+			//Only voting members may propose - keep asking until someone has learned it
+			time.Sleep(CatchupDelay)
+			continue
+		}
+		if !decided {
+			chatf(1, "Catchup: No peer knows slot %d, proposing a no-op", missing)
+			command = r.decideSlot(missing, NewNoOp(r.Self))
+		}
+		r.learned(missing, command)
+	}
+}
+
+//Ask each peer for the decided value of slot 'n'. If a peer has compacted the slot away
+//it is asked for its snapshot instead.
+func (r *Replica) learn(n int) (Command, bool) {
+	for _, address := range r.others() {
+		send := LearnReq{Slot: n}
+		recv := LearnResp{}
+		RandLatency()
+		if err := Call(address.String(), "Replica.Learn", send, &recv); err != nil {
+			continue
+		}
+		RandLatency()
+		if recv.Decided {
+			chatf(1, "Catchup: Learned slot %d from %s", n, address.String())
+			return recv.Command, true
+		}
+		if recv.Compacted {
+			chatf(1, "Catchup: %s has compacted slot %d, requesting its snapshot", address.String(), n)
+			r.Mutex.RLock()
+			request := RequestSnapshotReq{Address: r.Self, Applied: r.Applied}
+			r.Mutex.RUnlock()
+			var started bool
+			Call(address.String(), "Replica.RequestSnapshot", request, &started)
+			//Give the transfer time to finish before we look at the slot again
+			time.Sleep(CatchupDelay)
+			r.Mutex.RLock()
+			installed := n < r.Base
+			r.Mutex.RUnlock()
+			if installed {
+				return Command{}, true
+			}
+		}
 	}
+	return Command{}, false
+}
+
+//Apply decided slots to the database strictly in slot order, starting after the last
+//applied slot and stopping at the first slot that is not yet decided
+func (r *Replica) applyDecided() {
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	for {
+		r.Mutex.RLock()
+		next := r.Applied + 1
+		if next < r.Base || next >= r.Base+len(r.Slots) || !r.slot(next).Decided {
+			r.Mutex.RUnlock()
+			break
+		}
+		slot := *r.slot(next)
+		r.Mutex.RUnlock()
+		//A batch is applied as a whole before anything else gets a look at the database
+		for _, command := range slot.Command.Commands() {
+			commandResponse := r.applyOnce(slot.Index, command)
 
+			//Set a response value for the listener channel listening in main()
+			//so main() can continue on
+			r.respond(command, commandResponse)
+		}
+		r.Mutex.Lock()
+		r.Applied = slot.Index
+		r.activateConfig()
+		r.Mutex.Unlock()
+	}
+	if r.snapshotDue() {
+		r.takeSnapshot()
+	}
+}
+
+//Apply a command decided in slot 'index' to the database and return the response for the client
+func (r *Replica) apply(index int, command Command) string {
+	//No-ops only hold a place in the log
+	if command.IsNoOp() {
+		return ""
+	}
 	var commandResponse string
-	//Update the database
-	commandTokens := strings.Split(receive.Command.Command, " ")
+	commandTokens := strings.Split(command.Command, " ")
 	if commandTokens[0] == "put" {
-		r.Database[commandTokens[1]] = commandTokens[2]
+		r.setKey(index, commandTokens[1], commandTokens[2])
 		commandResponse = "[" + commandTokens[1] + "] => " + commandTokens[2] + " added to database"
+		if ttl, ok := ParseTTL(commandTokens[len(commandTokens)-1]); ok && len(commandTokens) == 4 {
+			r.setExpiry(commandTokens[1], command, ttl)
+			commandResponse += " for " + ttl.String()
+		}
 	} else if commandTokens[0] == "get" {
 		commandResponse = "[" + commandTokens[1] + "] => " + r.Database[commandTokens[1]]
 	} else if commandTokens[0] == "delete" {
 		dBaseVal := r.Database[commandTokens[1]]
-		delete(r.Database, commandTokens[1])
+		r.deleteKey(index, commandTokens[1])
 		commandResponse = "[" + commandTokens[1] + "] => " + dBaseVal + " deleted from database"
+	} else if commandTokens[0] == "expire" {
+		commandResponse = r.expire(index, commandTokens[1], commandTokens[2])
+	} else if commandTokens[0] == "cas" {
+		//Compare and swap in one step, so no other command can come in between
+		dBaseVal, ok := r.Database[commandTokens[1]]
+		if !ok {
+			commandResponse = "cas failed: [" + commandTokens[1] + "] is not in the database"
+		} else if dBaseVal != commandTokens[2] {
+			commandResponse = "cas failed: [" + commandTokens[1] + "] => " + dBaseVal
+		} else {
+			r.setKey(index, commandTokens[1], commandTokens[3])
+			commandResponse = "cas succeeded: [" + commandTokens[1] + "] => " + commandTokens[3]
+		}
+	} else if commandTokens[0] == "put-if-absent" {
+		if dBaseVal, ok := r.Database[commandTokens[1]]; ok {
+			commandResponse = "put-if-absent failed: [" + commandTokens[1] + "] => " + dBaseVal
+		} else {
+			r.setKey(index, commandTokens[1], commandTokens[2])
+			commandResponse = "[" + commandTokens[1] + "] => " + commandTokens[2] + " added to database"
+		}
+	} else if commandTokens[0] == "scan" || commandTokens[0] == "list" {
+		commandResponse = r.applyScan(commandTokens)
+	} else if commandTokens[0] == "txn" {
+		txn, err := ParseTxn(commandTokens)
+		if err != nil {
+			commandResponse = "txn rejected: " + err.Error()
+		} else {
+			commandResponse = r.applyTxn(index, txn)
+		}
+	} else if commandTokens[0] == AddNode || commandTokens[0] == AddLearner || commandTokens[0] == RemoveNode {
+		commandResponse = r.reconfigure(index, commandTokens)
 	} else {
 		commandResponse = "Unrecoginized command"
 	}
+	return commandResponse
+}
 
-	//Set a response value for the listener channel listening in main()
-	//so main() can continue on
-	_, ok := r.Listeners[receive.Command.Key]
-	if ok {
-		r.Listeners[receive.Command.Key] <- commandResponse
-	}
-	reply.Success = true
-	return nil
+//Set 'key' to 'value' in the database for a command applied in slot 'index'. Any TTL the
+//key had no longer applies. Must hold ApplyMutex.
+func (r *Replica) setKey(index int, key string, value string) {
+	r.Database[key] = value
+	r.indexKey(key)
+	r.clearExpiry(key)
+	r.changed(Change{Slot: index, Key: key, Value: value})
+}
+
+//Remove 'key' from the database for a command applied in slot 'index'. Must hold ApplyMutex.
+func (r *Replica) deleteKey(index int, key string) {
+	delete(r.Database, key)
+	r.unindexKey(key)
+	r.clearExpiry(key)
+	r.changed(Change{Slot: index, Key: key, Deleted: true})
 }
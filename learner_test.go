@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyConditional(t *testing.T) {
+	tests := []struct {
+		name         string
+		database     map[string]string
+		command      string
+		wantResponse string
+		wantDB       map[string]string
+	}{
+		{
+			name:         "cas with the expected value",
+			database:     map[string]string{"a": "1"},
+			command:      "cas a 1 2",
+			wantResponse: "cas succeeded: [a] => 2",
+			wantDB:       map[string]string{"a": "2"},
+		},
+		{
+			name:         "cas with another value",
+			database:     map[string]string{"a": "1"},
+			command:      "cas a 3 2",
+			wantResponse: "cas failed: [a] => 1",
+			wantDB:       map[string]string{"a": "1"},
+		},
+		{
+			name:         "cas on a missing key",
+			database:     map[string]string{},
+			command:      "cas a 1 2",
+			wantResponse: "cas failed: [a] is not in the database",
+			wantDB:       map[string]string{},
+		},
+		{
+			name:         "put-if-absent on a missing key",
+			database:     map[string]string{},
+			command:      "put-if-absent a 1",
+			wantResponse: "[a] => 1 added to database",
+			wantDB:       map[string]string{"a": "1"},
+		},
+		{
+			name:         "put-if-absent on a present key",
+			database:     map[string]string{"a": "1"},
+			command:      "put-if-absent a 2",
+			wantResponse: "put-if-absent failed: [a] => 1",
+			wantDB:       map[string]string{"a": "1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReplica(t, t.TempDir())
+			r.ApplyMutex.Lock()
+			defer r.ApplyMutex.Unlock()
+			for key, value := range test.database {
+				r.setKey(0, key, value)
+			}
+			if got := r.apply(1, Command{Command: test.command}); got != test.wantResponse {
+				t.Errorf("got response %q, want %q", got, test.wantResponse)
+			}
+			if !reflect.DeepEqual(r.Database, test.wantDB) {
+				t.Errorf("database is %v, want %v", r.Database, test.wantDB)
+			}
+		})
+	}
+}
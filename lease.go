@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+//--- Leader leases ---//
+
+/*   The elected leader asks for a lease on every heartbeat. A replica grants it when the
+     leader is also the one it has elected and it has not granted a lease to anybody else
+     that is still running. Until its grant runs out, it refuses Prepare and Accept from
+     every other proposer.
+
+     Once a phase 1 quorum has granted, no other proposer can get anything decided, so the
+     leader can answer reads from its own database - after applying every slot the
+     grantors had accepted a value in when they granted, and every slot it has sent an
+     Accept for itself, since a quorum of the others can decide one of those before the
+     leader's own acceptor has seen it. The leader counts its lease from
+     when it sent the heartbeat, before any grant was given, and stops using it max-drift
+     early, so it runs out before any grant does as long as clocks drift less than that.
+*/
+
+//Grant a lease to 'from' for the lease period, unless it already belongs to someone else
+func (r *Replica) grantLease(from Address) bool {
+	if *lease <= 0 || !r.isMember() {
+		return false
+	}
+	leader := r.leader()
+	if leader.String() != from.String() {
+		return false
+	}
+	r.LeaseMutex.Lock()
+	defer r.LeaseMutex.Unlock()
+	if r.LeaseHolder.String() != from.String() && time.Now().Before(r.LeaseExpires) {
+		return false
+	}
+	if r.LeaseHolder.String() != from.String() {
+		chatf(1, "Lease: Granting the lease to %s", from.String())
+	}
+	r.LeaseHolder = from
+	r.LeaseExpires = time.Now().Add(time.Duration(*lease) * time.Millisecond)
+	return true
+}
+
+//Has this replica promised a lease that is still running to somebody other than 'address'?
+func (r *Replica) leasedToOther(address Address) bool {
+	if *lease <= 0 {
+		return false
+	}
+	r.LeaseMutex.Lock()
+	defer r.LeaseMutex.Unlock()
+	return r.LeaseHolder.String() != address.String() && time.Now().Before(r.LeaseExpires)
+}
+
+//Record that 'address' granted us the lease in answer to the heartbeat sent at 'sent',
+//when it had accepted values up to slot 'index'
+func (r *Replica) granted(address Address, sent time.Time, index int) {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	peer := r.peer(address)
+	if sent.After(peer.Granted) {
+		peer.Granted = sent
+	}
+	if index > r.LeaseIndex {
+		r.LeaseIndex = index
+	}
+}
+
+//Note that this replica is about to send an Accept for slot 'index'
+func (r *Replica) proposing(index int) {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	if index > r.Proposed {
+		r.Proposed = index
+	}
+}
+
+//Highest slot a write decided before now can be in, while this replica holds the lease:
+//the highest one it has accepted, proposed on, or heard of from a grantor
+func (r *Replica) leaseIndex() int {
+	index := r.highestAccepted()
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	if r.LeaseIndex > index {
+		index = r.LeaseIndex
+	}
+	if r.Proposed > index {
+		index = r.Proposed
+	}
+	return index
+}
+
+//When the lease this replica holds runs out, counting max-drift off the end. The zero time
+//if it does not hold one.
+func (r *Replica) leaseExpiry() time.Time {
+	if *lease <= 0 || !r.isLeader() {
+		return time.Time{}
+	}
+	members := r.cell()
+	self := r.Self.String()
+
+	//Newest grants first - the lease lasts as long as the oldest grant a quorum needs
+	var grants []*Peer
+	r.PeerMutex.Lock()
+	for _, address := range members {
+		if address.String() != self {
+			grants = append(grants, r.peer(address))
+		}
+	}
+	r.PeerMutex.Unlock()
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Granted.After(grants[j].Granted) })
+
+	r.LeaseMutex.Lock()
+	selfGranted := r.LeaseHolder.String() == self && time.Now().Before(r.LeaseExpires)
+	r.LeaseMutex.Unlock()
+	votes := 0
+	if selfGranted {
+		votes = r.weight(r.Self)
+	}
+	length := time.Duration(*lease-*drift) * time.Millisecond
+	for _, peer := range grants {
+		if r.reached(Phase1, votes) {
+			break
+		}
+		if peer.Granted.IsZero() {
+			return time.Time{}
+		}
+		votes += r.weight(peer.Address)
+		if r.reached(Phase1, votes) {
+			return peer.Granted.Add(length)
+		}
+	}
+	if selfGranted && r.reached(Phase1, votes) {
+		//A cell of one
+		return time.Now().Add(length)
+	}
+	return time.Time{}
+}
+
+//Does this replica hold a lease it can serve reads under right now?
+func (r *Replica) holdsLease() bool {
+	return time.Now().Before(r.leaseExpiry())
+}
+
+//Highest slot this replica has accepted or decided a value in
+func (r *Replica) highestAccepted() int {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	for i := len(r.Slots) - 1; i >= 0; i-- {
+		if r.Slots[i].Accepted || r.Slots[i].Decided {
+			return r.Slots[i].Index
+		}
+	}
+	return r.Base - 1
+}
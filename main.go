@@ -13,11 +13,37 @@ import (
 )
 
 var chatty,
-	latency *int
+	latency,
+	snapslots,
+	snapbytes,
+	nooptimeout,
+	heartbeat,
+	suspect,
+	window,
+	alpha,
+	batchdelay,
+	batchsize,
+	quorum1,
+	quorum2,
+	nodeid,
+	lease,
+	drift,
+	clientretry *int
+var datadir,
+	weights *string
+var multipaxos,
+	mencius,
+	fast,
+	epaxos,
+	learner *bool
 
 type Nothing struct{}
 
 var sendNothing Nothing
+
+//Client session of this process's prompt, and the number of its latest request
+var clientID string
+var clientSeq int
 var returnNothing *Nothing
 
 func main() {
@@ -26,8 +52,73 @@ func main() {
 	//Take care of the -chatty and -verbose commands first
 	chatty = flag.Int("chatty", 0, "How verbose messages are")
 	latency = flag.Int("latency", 0, "Simulated network latency")
+	clientretry = flag.Int("client-retry", 10000, "Milliseconds to wait for a response before resending a request (0 waits forever)")
+	nodeid = flag.Int("id", 0, "Unique node ID used to break ties between ballots (default derived from the address)")
+	datadir = flag.String("datadir", ".", "Directory holding the write-ahead log and snapshots")
+	snapslots = flag.Int("snapshot-slots", 1000, "Take a snapshot after this many slots are applied (0 disables)")
+	snapbytes = flag.Int("snapshot-bytes", 4<<20, "Take a snapshot once the write-ahead log grows past this many bytes (0 disables)")
+	heartbeat = flag.Int("heartbeat", 500, "Milliseconds between heartbeats to the other replicas")
+	suspect = flag.Int("suspect", 2000, "Milliseconds without hearing from a replica before it is suspected")
+	alpha = flag.Int("alpha", 4, "Slots between deciding a membership change and it taking effect")
+	window = flag.Int("window", 4, "Most proposals this replica will have in flight at once")
+	batchdelay = flag.Int("batch-delay", 0, "Milliseconds to collect commands into one batch before proposing (0 disables)")
+	batchsize = flag.Int("batch-size", 64, "Most commands proposed together in one batch")
+	quorum1 = flag.Int("q1", 0, "Vote weight needed for phase 1 (Prepare), 0 for a majority")
+	quorum2 = flag.Int("q2", 0, "Vote weight needed for phase 2 (Accept), 0 for a majority")
+	weights = flag.String("weights", "", "Vote weight of each acceptor, e.g. 3410=2,3411=1 (default 1)")
+	learner = flag.Bool("learner", false, "Join as a non-voting learner that only receives decisions")
+	fast = flag.Bool("fast", false, "Send commands straight to the acceptors in a Fast Paxos round first")
+	epaxos = flag.Bool("epaxos", false, "Commit commands on a single key leaderlessly with Egalitarian Paxos")
+	mencius = flag.Bool("mencius", false, "Hand out slots round-robin so every member proposes on its own slots")
+	multipaxos = flag.Bool("multipaxos", false, "Elect a stable leader that skips Prepare in steady state")
+	nooptimeout = flag.Int("noop-timeout", 2000, "Milliseconds before an abandoned slot is filled with a no-op (0 disables)")
+	lease = flag.Int("lease", 0, "Milliseconds of leader lease granted on each heartbeat, letting the leader read locally (0 disables)")
+	drift = flag.Int("max-drift", 100, "Most milliseconds clocks may drift apart over one lease period")
 	flag.Parse()
 
+	if *window < 1 {
+		*window = 1
+	}
+	//A proposal can only be made on a slot whose membership is already known, which is at
+	//most 'alpha' slots past the last one applied
+	if *window > *alpha {
+		fmt.Println("-window cannot be larger than -alpha")
+		return
+	}
+
+	//A Multi-Paxos leader's promise covers every slot, which leaves no fast rounds
+	if *fast && *multipaxos {
+		fmt.Println("Fast Paxos cannot be combined with -multipaxos, using Multi-Paxos only")
+		*fast = false
+	}
+
+	//Mencius owners hold the implicit ballot 0 promise that the other two rely on
+	if *mencius && (*multipaxos || *fast) {
+		fmt.Println("Mencius cannot be combined with -multipaxos or -fast, using Mencius only")
+		*multipaxos = false
+		*fast = false
+	}
+
+	//Leases need a single proposer getting slots decided, which these modes do not have
+	if *lease > 0 && (*mencius || *fast || *epaxos) {
+		fmt.Println("Leader leases cannot be combined with -mencius, -fast or -epaxos, disabling leases")
+		*lease = 0
+	}
+	//EPaxos counts replicas for its fast and slow quorums rather than weighing votes
+	if *epaxos && (*quorum1 > 0 || *quorum2 > 0 || *weights != "") {
+		fmt.Println("EPaxos uses majority quorums and cannot be combined with -q1, -q2 or -weights, using majorities")
+		*quorum1 = 0
+		*quorum2 = 0
+		*weights = ""
+	}
+	if *lease > 0 && *drift >= *lease {
+		fmt.Println("The lease period must be longer than -max-drift, disabling leases")
+		*lease = 0
+	}
+	if *lease > 0 && *lease < *heartbeat {
+		fmt.Println("Warning: the lease period is shorter than the heartbeat interval and will lapse between renewals")
+	}
+
 	if *chatty < 0 {
 		*chatty = 0
 	} else if *chatty > 2 {
@@ -39,23 +130,41 @@ func main() {
 		fmt.Println("Not enough replica addresses specified to create a cell")
 		return
 	}
-
-	//If no colon is found, assume number given is a port and prepend colon to it
-	for i := 0; i < len(cell); i++ {
-		if !strings.Contains(cell[i], ":") {
-			cell[i] = ":" + cell[i]
-		}
+	if *learner && len(cell) < 2 {
+		fmt.Println("A learner needs the address of at least one voting member of the cell")
+		return
 	}
 
 	fmt.Println("Welcome to Paxos v.1.1")
 	fmt.Println("By Shawn Wonder")
-	fmt.Println("Type 'help' for a list of commands\n")
+	fmt.Println("Type 'help' for a list of commands")
+	fmt.Println()
 	fmt.Println("Chattyness  : " + strconv.Itoa(*chatty))
-	fmt.Println("Latency (ms): " + strconv.Itoa(*latency) + "\n")
+	fmt.Println("Latency (ms): " + strconv.Itoa(*latency))
+	fmt.Println("Data dir    : " + *datadir + "\n")
 
 	//Create the replica
 	replica := CreateReplica(cell)
+	if err := replica.validateQuorums(); err != nil {
+		fmt.Println("Invalid quorum configuration:", err)
+		return
+	}
 	Listen(replica)
+	if err := replica.checkNodeIDs(); err != nil {
+		fmt.Println("Invalid node ID:", err)
+		return
+	}
+	fmt.Println("Node ID     : " + strconv.Itoa(replica.ID))
+	//A new session for every run, since request numbers start over
+	clientID = replica.Self.String() + "/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	go replica.detectFailures()
+	go replica.expireKeys()
+	if *nooptimeout > 0 {
+		go replica.reapAbandoned()
+		if *epaxos {
+			go replica.recoverAbandoned()
+		}
+	}
 
 	PrintPrompt()
 
@@ -68,91 +177,142 @@ func main() {
 			//Insert key and value into paxos - put <key> <value>
 			if commandTokens[0] == "put" {
 				if len(commandTokens) == 3 {
-					command := Command{}
-					command.Address = replica.Cell[0]
-					command.Command = strings.Join(commandTokens, " ")
-					command.Promise = Sequence{N: 0, Address: replica.Cell[0]}
-					command.Tag = rand.Int()
-					key := command.Address.IP + "-" + strconv.Itoa(command.Tag)
-					command.Key = key
-
-					responseChannel := make(chan string, 1)
-					replica.Mutex.RLock()
-					replica.Listeners[key] = responseChannel
-					replica.Mutex.RUnlock()
-
-					send := ProposeReq{Command: command}
-					reply := ProposeResp{}
-					RandLatency()
-					Call(replica.Cell[0].String(), "Replica.Propose", send, &reply)
-					RandLatency()
-					fmt.Println(<-replica.Listeners[key])
+					fmt.Println(submit(replica, commandTokens))
+				} else if _, ok := ParseTTL(commandTokens[len(commandTokens)-1]); ok && len(commandTokens) == 4 {
+					fmt.Println(submit(replica, commandTokens))
 				} else {
-					fmt.Println("Number of arguments supplied incorrect - usage: put <key> <value>")
+					fmt.Println("Number of arguments supplied incorrect - usage: put <key> <value> [ttl=<duration>]")
 				}
-			//Find key in the active ring - get <key>
+				//Find key in the active ring - get <key>
 			} else if commandTokens[0] == "get" {
 				if len(commandTokens) == 2 {
-					command := Command{}
-					command.Address = replica.Cell[0]
-					command.Command = strings.Join(commandTokens, " ")
-					command.Promise = Sequence{N: 0, Address: replica.Cell[0]}
-					command.Tag = rand.Int()
-					key := command.Address.IP + "-" + strconv.Itoa(command.Tag)
-					command.Key = key
-
-					responseChannel := make(chan string, 1)
-					replica.Mutex.RLock()
-					replica.Listeners[key] = responseChannel
-					replica.Mutex.RUnlock()
-
-					send := ProposeReq{Command: command}
-					reply := ProposeResp{}
-					RandLatency()
-					Call(replica.Cell[0].String(), "Replica.Propose", send, &reply)
-					RandLatency()
-					fmt.Println(<-replica.Listeners[key])
+					//EPaxos orders reads by key like any other command, so they stay in the log
+					if *epaxos {
+						fmt.Println(submit(replica, commandTokens))
+					} else {
+						fmt.Println(read(replica, commandTokens[1]))
+					}
 				} else {
 					fmt.Println("Number of arguments supplied incorrect - usage: get <key>")
 				}
-			//Delete key from the active ring - delete <key>
+				//Read key from this replica without checking it is up to date - stale-get <key>
+			} else if commandTokens[0] == "stale-get" {
+				if len(commandTokens) == 2 {
+					fmt.Println(replica.readLocal(commandTokens[1]))
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: stale-get <key>")
+				}
+				//Swap in a new value only if the key holds the expected one - cas <key> <expected> <new>
+			} else if commandTokens[0] == "cas" {
+				if len(commandTokens) == 4 {
+					fmt.Println(submit(replica, commandTokens))
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: cas <key> <expected> <new>")
+				}
+				//Insert key only if it is not in the database yet - put-if-absent <key> <value>
+			} else if commandTokens[0] == "put-if-absent" {
+				if len(commandTokens) == 3 {
+					fmt.Println(submit(replica, commandTokens))
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: put-if-absent <key> <value>")
+				}
+				//Apply several reads and writes atomically - txn [if <guard>...] then <op>... [else <op>...]
+			} else if commandTokens[0] == "txn" {
+				//Check it here so that a malformed transaction never takes up a slot
+				if *epaxos {
+					fmt.Println("Transactions cannot be used with -epaxos, which does not order the log against single-key commands")
+				} else if _, err := ParseTxn(commandTokens); err == nil {
+					fmt.Println(submit(replica, commandTokens))
+				} else {
+					fmt.Println("Malformed transaction: " + err.Error() + " - usage: txn [if <key> ==|!= <value>...] then <op>... [else <op>...]")
+				}
+				//Print changes to a key, or to every key with a prefix, as they are applied - watch <key|prefix*> [from=<slot>]
+			} else if commandTokens[0] == "watch" {
+				from := -1
+				ok := len(commandTokens) == 2
+				if len(commandTokens) == 3 && strings.HasPrefix(commandTokens[2], "from=") {
+					slot, err := strconv.Atoi(strings.TrimPrefix(commandTokens[2], "from="))
+					from = slot
+					ok = err == nil && slot >= 0
+				}
+				if ok && *epaxos {
+					fmt.Println("watch cannot be used with -epaxos, whose commands are not applied in slots")
+				} else if ok {
+					key := commandTokens[1]
+					prefix := strings.HasSuffix(key, "*")
+					key = strings.TrimSuffix(key, "*")
+					fmt.Println("Watching " + commandTokens[1] + " in the background")
+					go watch(replica, key, prefix, from)
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: watch <key|prefix*> [from=<slot>]")
+				}
+				//List keys in order through the log - scan <start> <end> [limit], list <prefix>
+				//or from this replica's copy, which may be out of date - stale-scan, stale-list
+			} else if commandTokens[0] == "scan" || commandTokens[0] == "stale-scan" {
+				limit := 1
+				if len(commandTokens) == 4 {
+					limit, _ = strconv.Atoi(commandTokens[3])
+				}
+				if (len(commandTokens) == 3 || len(commandTokens) == 4) && limit > 0 {
+					if commandTokens[0] == "scan" && *epaxos {
+						fmt.Println("scan cannot be used with -epaxos, which does not order the log against single-key commands - use stale-scan")
+					} else if commandTokens[0] == "scan" {
+						fmt.Println(submit(replica, commandTokens))
+					} else {
+						fmt.Println(replica.scanLocal(commandTokens))
+					}
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: " + commandTokens[0] + " <start> <end> [limit]")
+				}
+			} else if commandTokens[0] == "list" || commandTokens[0] == "stale-list" {
+				if len(commandTokens) == 2 {
+					if commandTokens[0] == "list" && *epaxos {
+						fmt.Println("list cannot be used with -epaxos, which does not order the log against single-key commands - use stale-list")
+					} else if commandTokens[0] == "list" {
+						fmt.Println(submit(replica, commandTokens))
+					} else {
+						fmt.Println(replica.scanLocal(commandTokens))
+					}
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: " + commandTokens[0] + " <prefix>")
+				}
+				//Delete key from the active ring - delete <key>
 			} else if commandTokens[0] == "delete" {
 				if len(commandTokens) == 2 {
-					command := Command{}
-					command.Address = replica.Cell[0]
-					command.Command = strings.Join(commandTokens, " ")
-					command.Promise = Sequence{N: 0, Address: replica.Cell[0]}
-					command.Tag = rand.Int()
-					key := command.Address.IP + "-" + strconv.Itoa(command.Tag)
-					command.Key = key
-
-					responseChannel := make(chan string, 1)
-					replica.Mutex.RLock()
-					replica.Listeners[key] = responseChannel
-					replica.Mutex.RUnlock()
-					send := ProposeReq{Command: command}
-					reply := ProposeResp{}
-					RandLatency()
-					Call(replica.Cell[0].String(), "Replica.Propose", send, &reply)
-					RandLatency()
-					fmt.Println(<-replica.Listeners[key])
+					fmt.Println(submit(replica, commandTokens))
 				} else {
 					fmt.Println("Number of arguments supplied incorrect - usage: delete <key>")
 				}
-			//Display information about the current node - dump
+				//Add a replica to the cell - addnode <addr:port>
+				//Remove a replica from the cell - removenode <addr:port>
+				//Add a non-voting learner replica - addlearner <addr:port>
+			} else if commandTokens[0] == AddNode || commandTokens[0] == AddLearner || commandTokens[0] == RemoveNode {
+				if len(commandTokens) == 2 {
+					//Every replica has to see the same address, so resolve it here
+					address, err := ParseAddress(commandTokens[1])
+					if err != nil {
+						fmt.Println(err)
+					} else {
+						commandTokens[1] = address.String()
+						fmt.Println(submit(replica, commandTokens))
+					}
+				} else {
+					fmt.Println("Number of arguments supplied incorrect - usage: " + commandTokens[0] + " <addr:port>")
+				}
+				//Display information about the current node - dump
 			} else if commandTokens[0] == "dump" {
 				var reply *string
-				Call(replica.Cell[0].String(), "Replica.Dump", sendNothing, &reply)
+				Call(replica.Self.String(), "Replica.Dump", sendNothing, &reply)
 				fmt.Println(*reply)
-			//Dump information on all replicas - dumpall
+				//Dump information on all replicas - dumpall
 			} else if commandTokens[0] == "dumpall" {
 				var reply string
-				for _, address := range replica.Cell {
+				for _, address := range append([]Address{replica.Self}, replica.everyoneElse()...) {
 					Call(address.String(), "Replica.Dump", sendNothing, &reply)
 					fmt.Println("-----" + address.String() + "-----")
 					fmt.Println(reply)
 				}
-			//Check if node is alive - ping <address>:<port>
+				//Check if node is alive - ping <address>:<port>
 			} else if commandTokens[0] == "ping" {
 				if len(commandTokens) == 2 {
 					var reply *int
@@ -165,22 +325,38 @@ func main() {
 				} else {
 					fmt.Println("Number of arguments supplied incorrect - usage: ping <addr>")
 				}
-			//List of help commands
+				//List of help commands
 			} else if commandTokens[0] == "help" {
 				var buffer bytes.Buffer
 				buffer.WriteString("\n--- List of Paxos Commands --- \n")
 				buffer.WriteString("--- Key/Value Operations --- \n")
 				buffer.WriteString("     put <key> <value> : Insert the <key> and <value> into the database\n")
+				buffer.WriteString("     put <key> <value> ttl=<duration> : Insert <key> until <duration> (e.g. 30s) passes\n")
 				buffer.WriteString("     get <key>         : Find <key> in the database\n")
+				buffer.WriteString("     stale-get <key>   : Find <key> in this replica's copy, which may be out of date\n")
 				buffer.WriteString("     delete <key>      : Delete <key> from the database\n")
+				buffer.WriteString("     cas <key> <expected> <new>  : Set <key> to <new> only if it holds <expected>\n")
+				buffer.WriteString("     put-if-absent <key> <value> : Insert <key> only if it is not in the database\n")
+				buffer.WriteString("     scan <start> <end> [limit] : List keys from <start> up to but not including <end>\n")
+				buffer.WriteString("     list <prefix>     : List every key that starts with <prefix> (neither with -epaxos)\n")
+				buffer.WriteString("     stale-scan, stale-list     : Same as scan and list, from this replica's copy\n")
+				buffer.WriteString("     watch <key|prefix*> [from=<slot>] : Print every change to <key>, or to keys starting\n")
+				buffer.WriteString("                         with <prefix>, from <slot> on (default from now, not with -epaxos)\n")
+				buffer.WriteString("     txn [if <key> ==|!= <value>...] then <op>... [else <op>...]\n")
+				buffer.WriteString("                       : Atomically run the put/get/delete ops after 'then' if every\n")
+				buffer.WriteString("                         guard holds, or the ones after 'else' if not (not with -epaxos)\n")
 				buffer.WriteString("     quit              : Shut down this replica instance\n")
+				buffer.WriteString("--- Cell Membership --- \n")
+				buffer.WriteString("     addnode <addr:port>    : Add the replica at addr:port to the cell\n")
+				buffer.WriteString("     addlearner <addr:port> : Add the replica at addr:port as a non-voting learner\n")
+				buffer.WriteString("     removenode <addr:port> : Remove the replica or learner at addr:port from the cell\n")
 				buffer.WriteString("--- Debugging Commands ---\n")
 				buffer.WriteString("     dump              : Display information about the current replica\n")
 				buffer.WriteString("     dumpall           : Display information about all active replicas\n")
 				buffer.WriteString("     ping <addr:port>  : Checks to see if replica at address:port is listening\n")
 
 				fmt.Println(buffer.String())
-			//Exit program
+				//Exit program
 			} else if commandTokens[0] == "quit" {
 				fmt.Println("Quitting...")
 				os.Exit(1)
@@ -196,3 +372,58 @@ func main() {
 		fmt.Fprintln(os.Stderr, "Reading standard input:", err)
 	}
 }
+
+//Linearizable read of 'key' that does not use a slot
+func read(replica *Replica, key string) string {
+	send := ReadReq{Key: key}
+	reply := ReadResp{}
+	RandLatency()
+	Call(replica.Self.String(), "Replica.Read", send, &reply)
+	RandLatency()
+	return reply.Response
+}
+
+//Propose the command in 'commandTokens' through the local replica and wait for its response
+func submit(replica *Replica, commandTokens []string) string {
+	command := Command{}
+	command.Address = replica.Self
+	command.Command = strings.Join(commandTokens, " ")
+	command.Promise = replica.sequence(0)
+	command.Tag = rand.Int()
+	key := command.Address.IP + "-" + strconv.Itoa(command.Tag)
+	command.Key = key
+
+	//Under -epaxos the slot log is applied in a different order against EPaxos commands on
+	//each replica, so only the commands EPaxos commits carry a session
+	session := !*epaxos || replica.leaderless(command)
+
+	responseChannel := make(chan string, 1)
+	replica.Mutex.Lock()
+	//Number the request within this session so that a retry is not applied twice
+	if session {
+		clientSeq++
+		command.Client = clientID
+		command.ClientSeq = clientSeq
+	}
+	replica.Listeners[key] = responseChannel
+	replica.Mutex.Unlock()
+
+	for {
+		go func() {
+			send := ProposeReq{Command: command}
+			reply := ProposeResp{}
+			RandLatency()
+			Call(replica.Self.String(), "Replica.Propose", send, &reply)
+			RandLatency()
+		}()
+		if *clientretry <= 0 {
+			return <-responseChannel
+		}
+		select {
+		case response := <-responseChannel:
+			return response
+		case <-time.After(time.Duration(*clientretry) * time.Millisecond):
+			fmt.Printf("No response to \"%s\" after %d ms, retrying\n", command.Command, *clientretry)
+		}
+	}
+}
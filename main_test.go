@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	setTestFlags()
+	os.Exit(m.Run())
+}
+
+//Give every flag its default from main(), since main() is what defines them
+func setTestFlags() {
+	intFlag := func(value int) *int { return &value }
+	boolFlag := func(value bool) *bool { return &value }
+	stringFlag := func(value string) *string { return &value }
+	chatty = intFlag(0)
+	latency = intFlag(0)
+	clientretry = intFlag(10000)
+	nodeid = intFlag(0)
+	datadir = stringFlag(".")
+	snapslots = intFlag(1000)
+	snapbytes = intFlag(4 << 20)
+	heartbeat = intFlag(500)
+	suspect = intFlag(2000)
+	alpha = intFlag(4)
+	window = intFlag(4)
+	batchdelay = intFlag(0)
+	batchsize = intFlag(64)
+	quorum1 = intFlag(0)
+	quorum2 = intFlag(0)
+	weights = stringFlag("")
+	learner = boolFlag(false)
+	fast = boolFlag(false)
+	epaxos = boolFlag(false)
+	mencius = boolFlag(false)
+	multipaxos = boolFlag(false)
+	nooptimeout = intFlag(2000)
+	lease = intFlag(0)
+	drift = intFlag(100)
+}
+
+//Replica for the first of three local addresses, keeping its log and snapshot in 'dir'.
+//Nothing is listening, so it only works on its own state.
+func newTestReplica(t *testing.T, dir string) *Replica {
+	t.Helper()
+	*datadir = dir
+	r := CreateReplica([]string{"127.0.0.1:3410", "127.0.0.1:3411", "127.0.0.1:3412"})
+	t.Cleanup(func() { r.WAL.Close() })
+	return r
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+//--- Mencius round-robin slot ownership ---//
+
+/*   Slot s belongs to member s mod n of the cell, sorted by address. The owner starts out
+     holding an implicit promise (ballot 0) on its slots, so it proposes with Accept alone:
+
+mencius(v):
+    choose the owner's next unused slot s
+    send accept(s, 0, v) to all
+    if accept_ok from a phase 2 quorum:
+        send decided(s, v) to all
+
+    Once a replica sees another owner use slot s, it skips every slot of its own below s
+    by deciding a no-op there directly - nobody else may propose anything but a no-op on
+    an owner's slot, so the skip cannot conflict. Slots of an owner that is suspected of
+    having failed are revoked with a full Prepare/Accept round of a no-op.
+
+    An owner that restarts forgets which of its slots it was proposing on, and skipping
+    one of those could decide a no-op where a quorum already accepted its value. So the
+    owner logs each slot before proposing on it, never proposes on a logged slot again,
+    and fills any of them still missing with a full round instead of skipping it.
+*/
+
+//Members of the cell in effect for slot 'index', in the order slots are handed out
+func (r *Replica) cellAt(index int) []Address {
+	r.Mutex.RLock()
+	cell := append([]Address(nil), r.members()...)
+	for _, config := range r.Pending {
+		if config.From <= index {
+			cell = append([]Address(nil), config.Cell...)
+		}
+	}
+	r.Mutex.RUnlock()
+	sort.Slice(cell, func(i, j int) bool { return cell[i].String() < cell[j].String() })
+	return cell
+}
+
+//Replica that owns slot 'index'
+func (r *Replica) ownerOf(index int) Address {
+	cell := r.cellAt(index)
+	if len(cell) == 0 {
+		return Address{}
+	}
+	return cell[index%len(cell)]
+}
+
+func (r *Replica) owns(index int) bool {
+	owner := r.ownerOf(index)
+	return owner.String() == r.Self.String()
+}
+
+//First slot at or after 'from' that this replica owns. Returns false if it is on its
+//way out of the cell and will not own any more.
+func (r *Replica) nextOwned(from int) (int, bool) {
+	r.Mutex.RLock()
+	_, member := without(r.latestConfig().Cell, r.Self.String())
+	r.Mutex.RUnlock()
+	index := from
+	for !r.owns(index) {
+		//Past the last configuration that includes us
+		if !member && !r.inCell(index) {
+			return 0, false
+		}
+		index++
+	}
+	return index, true
+}
+
+//Is the membership that owns slot 'index' known for certain? A change not applied yet
+//could still hand it to another owner.
+func (r *Replica) ownerKnown(index int) bool {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	return !r.awaitingConfig(index)
+}
+
+//Is this replica one of the members in effect for slot 'index'?
+func (r *Replica) inCell(index int) bool {
+	_, member := without(r.cellAt(index), r.Self.String())
+	return member
+}
+
+//Has anything been proposed, accepted, or decided in slot 'index' yet?
+func (r *Replica) slotUsed(index int) bool {
+	r.ReserveMutex.Lock()
+	reserved := r.Reserved[index]
+	r.ReserveMutex.Unlock()
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	if index < r.Base {
+		return true
+	}
+	if index >= r.Base+len(r.Slots) {
+		return reserved
+	}
+	slot := r.slot(index)
+	return reserved || slot.Decided || slot.Accepted || slot.Sequence.N > 0
+}
+
+//Reserve the next slot this replica owns that has not been used yet
+func (r *Replica) reserveOwnedSlot() (int, bool) {
+	r.MenciusMutex.Lock()
+	defer r.MenciusMutex.Unlock()
+	r.Mutex.RLock()
+	from := r.Applied + 1
+	//Slots we proposed on before a restart may already hold one of our values
+	if r.Owned >= from {
+		from = r.Owned + 1
+	}
+	r.Mutex.RUnlock()
+	if r.NextOwned > from {
+		from = r.NextOwned
+	}
+	for {
+		index, ok := r.nextOwned(from)
+		if !ok {
+			return 0, false
+		}
+		if r.slotUsed(index) {
+			from = index + 1
+			continue
+		}
+		//reserveSlot also waits out a pending membership change, which can give the slot
+		//to another owner
+		if reserved := r.reserveSlot(index); reserved != index || !r.owns(index) {
+			r.releaseSlot(reserved)
+			from = index + 1
+			continue
+		}
+		r.NextOwned = index + 1
+		//Logged before any Accept goes out, so a restart cannot skip it
+		r.Mutex.Lock()
+		if index > r.Owned {
+			r.Owned = index
+			r.persist(LogEntry{Kind: LogOwned, Slot: index})
+		}
+		r.Mutex.Unlock()
+		return index, true
+	}
+}
+
+//Propose 'command' on this replica's next slot. Returns false if the slot was revoked
+//from under us, in which case the caller should retry on a later one.
+func (r *Replica) menciusPropose(command Command) bool {
+	index, ok := r.reserveOwnedSlot()
+	if !ok {
+		chatf(1, "Mencius: This replica is leaving the cell and owns no more slots")
+		r.respond(command, "This replica is leaving the cell and can no longer propose")
+		return true
+	}
+	defer r.releaseSlot(index)
+
+	chatf(1, "Mencius: Proposing \"%s\" on owned slot #: %d", command.Command, index)
+	if !r.leaderAccept(index, r.sequence(0), command) {
+		chatf(1, "Mencius: Slot %d was revoked", index)
+		return false
+	}
+	return true
+}
+
+//Another owner has used slot 'n', so skip every slot of ours before it that we have not used
+func (r *Replica) skipTo(n int) {
+	if !r.isMember() {
+		return
+	}
+	r.MenciusMutex.Lock()
+	defer r.MenciusMutex.Unlock()
+	r.Mutex.RLock()
+	from := r.Applied + 1
+	r.Mutex.RUnlock()
+	if r.NextOwned > from {
+		from = r.NextOwned
+	}
+	for index, ok := r.nextOwned(from); ok && index < n; index, ok = r.nextOwned(index + 1) {
+		//The rest are skipped once the membership they fall under is known
+		if !r.ownerKnown(index) {
+			chatf(2, "Mencius: Not skipping slot %d until the membership it falls under is known", index)
+			return
+		}
+		if !r.slotUsed(index) {
+			r.skip(index)
+		}
+		r.NextOwned = index + 1
+	}
+}
+
+//Decide a no-op in our own slot 'index' without a round of Accepts, unless we may have
+//proposed on it before a restart
+func (r *Replica) skip(index int) {
+	command := NewNoOp(r.Self)
+	r.Mutex.RLock()
+	proposed := index <= r.Owned
+	r.Mutex.RUnlock()
+	if proposed {
+		chatf(1, "Mencius: Owned slot %d may hold a value from before a restart, filling it with a full round", index)
+		r.learned(index, r.decideSlot(index, command))
+		return
+	}
+	chatf(2, "Mencius: Skipping owned slot %d", index)
+	r.broadcastDecide(index, command)
+	r.learned(index, command)
+}
+
+//Missing slot 'index' is holding up the log. Returns true once it has been dealt with
+//the Mencius way: skipped if it is ours, or revoked if its owner is suspected. Returns
+//false while its owner is alive and should still be given the chance to use it.
+func (r *Replica) menciusFill(index int) bool {
+	owner := r.ownerOf(index)
+	if owner.String() == r.Self.String() {
+		r.skipTo(index + 1)
+		return true
+	}
+	if r.alive(owner) {
+		chatf(1, "Mencius: Waiting for %s to use slot %d", owner.String(), index)
+		time.Sleep(CatchupDelay)
+		return false
+	}
+	chatf(1, "Mencius: Revoking slot %d from suspected owner %s", index, owner.String())
+	command := r.decideSlot(index, NewNoOp(r.Self))
+	r.learned(index, command)
+	return true
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"strings"
+	"time"
 )
 
 //--- Proposer Role Data structures and Methods ---//
 type ProposeReq struct {
-	Command Command
+	Command   Command
+	Forwarded bool //Already handed on by another replica - propose it here regardless
 }
 type ProposeResp struct {
-	Okay bool
+	Okay   bool
+	Leader Address //Replica that proposed the command
 }
 
 /*   Proposer code below is built off of this pseudo-code
@@ -17,10 +19,10 @@ proposer(v):
     while not decided:
 	    choose n, unique and higher than any n seen so far
 	    send prepare(n) to all servers including self
-	    if prepare_ok(n, na, va) from majority:
+	    if prepare_ok(n, na, va) from a phase 1 quorum:
 	      v' = va with highest na; choose own v otherwise
 	      send accept(n, v') to all
-	      if accept_ok(n) from majority:
+	      if accept_ok(n) from a phase 2 quorum:
 	        send decided(v') to all
 
 	acceptor state on each node (persistent):
@@ -29,48 +31,119 @@ proposer(v):
 */
 
 func (r *Replica) Propose(receive ProposeReq, reply *ProposeResp) error {
-	r.Mutex.RLock()
+	//EPaxos: commands on a single key are committed from here, without a leader or a slot
+	if r.leaderless(receive.Command) {
+		r.epaxosPropose(receive.Command)
+		reply.Okay = true
+		reply.Leader = r.Self
+		return nil
+	}
+
+	//Fast Paxos: go straight to the acceptors, and only fall back to the leader and a
+	//classic round when the fast round collides with another command
+	if *fast && !receive.Forwarded && r.isMember() {
+		if r.fastPropose(receive.Command) {
+			reply.Okay = true
+			reply.Leader = r.Self
+			return nil
+		}
+	}
+
+	//Only the elected leader proposes - everyone else hands the command to it so that
+	//replicas do not compete for the same slots. Mencius members own slots of their own.
+	for !receive.Forwarded && !r.isLeader() && !(*mencius && r.isMember()) {
+		leader := r.leader()
+		chatf(1, "Propose: Forwarding \"%s\" to the elected leader %s", receive.Command.Command, leader.String())
+		send := ProposeReq{Command: receive.Command, Forwarded: true}
+		recv := ProposeResp{}
+		RandLatency()
+		err := Call(leader.String(), "Replica.Propose", send, &recv)
+		RandLatency()
+		if err == nil {
+			reply.Okay = recv.Okay
+			reply.Leader = recv.Leader
+			return nil
+		}
+		//The leader most likely crashed - try whoever is elected in its place
+		r.suspectFailed(leader)
+		if elected := r.leader(); elected.String() != leader.String() {
+			chatf(1, "Propose: Unable to reach %s, forwarding to %s instead: %v", leader.String(), elected.String(), err)
+			continue
+		}
+		if !r.isMember() {
+			chatf(1, "Propose: Unable to reach %s and this replica does not vote: %v", leader.String(), err)
+			r.respond(receive.Command, "No voting member of the cell is reachable")
+			return nil
+		}
+		chatf(1, "Propose: Unable to reach %s, proposing locally: %v", leader.String(), err)
+		break
+	}
+	reply.Leader = r.Self
+
+	//Let commands that arrive close together share a slot
+	if *batchdelay > 0 && !receive.Command.IsBatch() {
+		reply.Okay = r.proposeBatched(receive.Command)
+		return nil
+	}
+
+	//Wait for room in the window of slots this replica has in flight
+	r.Window <- Nothing{}
+	defer func() { <-r.Window }()
+
+	//Mencius: every member proposes on its own slots, skipping the Prepare phase
+	if *mencius {
+		sleepTime := 5 // measured in ms
+		for !r.menciusPropose(receive.Command) {
+			RandLatency(sleepTime)
+			sleepTime *= 2
+		}
+		reply.Okay = true
+		return nil
+	}
+
+	//Multi-Paxos: a stable leader only needs the Accept phase for each command
+	if *multipaxos {
+		sleepTime := 5 // measured in ms
+		for !r.leaderPropose(receive.Command) {
+			sleepTime = r.backoff(sleepTime)
+		}
+		reply.Okay = true
+		return nil
+	}
+
 	sleepTime := 5 // measured in ms
 	round := 1
 	highestN := 0
-	slot := Slot{Index: 0, Sequence: Sequence{N: 0, Address: r.Cell[0]}}
+	slot := Slot{Index: 0, Sequence: r.sequence(0)}
 	vCommand := receive.Command
-	vaCommand := Command{}
-	numTrue, numFalse := 0, 0
+	var vaCommand Command
+	var vaSeq Sequence
+	var fastVotes *FastVotes
+	var numTrue, numFalse int
 
-	//Find first undecided slot
-	undecidedSlotFound := false
-	for i := 0; i < len(r.Slots); i++ {
-		if !r.Slots[i].Decided {
-			slot = r.Slots[i]
-			undecidedSlotFound = true
-			break
-		}
-	}
-	if !undecidedSlotFound {
-		r.getSlots(len(r.Slots))
-		slot.Index = len(r.Slots) - 1
-	}
+	//Find first undecided slot that no other local proposal is working on
+	slot.Index = r.reserveSlot(0)
+	defer func() { r.releaseSlot(slot.Index) }()
+	slot.Sequence = r.slotCopy(slot.Index).Sequence
 	//while not decided
 	for {
 		chatf(1, "Propose: Round: %d", round)
-		r.getSlots(slot.Index)
 
 		//Check to see if the slot has been decided
-		if r.Slots[slot.Index].Decided {
-			if r.Slots[slot.Index].Command.Tag == receive.Command.Tag {
-				r.sendCommand(vCommand)
+		if current := r.slotCopy(slot.Index); current.Decided {
+			//Ours - main() hears the result from the learner once it is applied
+			if current.Command.Tag == receive.Command.Tag {
+				reply.Okay = true
 				return nil
 			}
 			highestN = 0
 			vCommand = receive.Command
-			slot.Sequence = Sequence{N: 0, Address: r.Cell[0]}
+			slot.Sequence = r.sequence(0)
 			slot.Command = Command{}
 			slot.Accepted = false
 			slot.Decided = false
-			vaCommand = Command{Command: ""}
-			numTrue, numFalse = 0, 0
-			slot.Index = slot.Index + 1
+			r.releaseSlot(slot.Index)
+			slot.Index = r.reserveSlot(slot.Index + 1)
 			chatf(1, "Propose: Slot already decided moving slot index to: %d", slot.Index)
 		}
 
@@ -83,12 +156,18 @@ func (r *Replica) Propose(receive ProposeReq, reply *ProposeResp) error {
 			n = highestN + 1
 		}
 
+		//Count this round's replies from scratch, as decideSlot does
+		numTrue, numFalse = 0, 0
+		vaCommand = Command{}
+		vaSeq = Sequence{}
+		fastVotes = NewFastVotes()
+
 		//send prepare(n) to all servers including self
-		response := make(chan PrepareResp, len(r.Cell))
-		r.Mutex.RUnlock()
-		for _, address := range r.Cell {
+		cell := r.cell()
+		response := make(chan PrepareResp, len(cell))
+		for _, address := range cell {
 			go func(address Address, slotIndex int, n int, response chan PrepareResp) {
-				send := PrepareReq{slotIndex, Sequence{N: n, Address: r.Cell[0]}}
+				send := PrepareReq{slotIndex, r.sequence(n)}
 				recv := PrepareResp{}
 				RandLatency()
 				Call(address.String(), "Replica.Prepare", send, &recv)
@@ -96,56 +175,66 @@ func (r *Replica) Propose(receive ProposeReq, reply *ProposeResp) error {
 				response <- recv
 			}(address, slot.Index, n, response)
 		}
-		r.Mutex.RLock()
 
 		//Process prepare responses
-		for i := 0; i < len(r.Cell); i++ {
+		for i := 0; i < len(cell); i++ {
 			prepareResp := <-response
 			if prepareResp.Okay {
-				numTrue++
+				numTrue += r.weight(prepareResp.Voter)
+				//Values from the fast round are weighed against each other below
+				if prepareResp.Fast {
+					fastVotes.Add(prepareResp.Command, r.weight(prepareResp.Voter))
+				}
 			} else {
-				numFalse++
+				numFalse += r.weight(prepareResp.Voter)
 			}
 			//New highest n value returned
 			if prepareResp.Promised.N > highestN {
 				chatf(1, "Propose: New highest n returned from prepare N: %d, Address: %s", prepareResp.Promised.N, prepareResp.Promised.Address.String())
 				highestN = prepareResp.Promised.N
-				//New highest command was accepted
-				if prepareResp.Command.Command != "" {
-					vaCommand = prepareResp.Command
-					chatf(1, "Propose: New highest command returned from prepare %s", prepareResp.Command.Command)
-				}
 			}
-			//A majority was reached - exit loop
-			if r.majority(numTrue) || r.majority(numFalse) {
+			//New highest command was accepted
+			if prepareResp.Okay && prepareResp.Command.Command != "" && !prepareResp.Fast && (vaCommand.Command == "" || prepareResp.Accepted.Cmp(vaSeq) > 0) {
+				vaCommand = prepareResp.Command
+				vaSeq = prepareResp.Accepted
+				chatf(1, "Propose: New highest command returned from prepare %s", prepareResp.Command.Command)
+			}
+			//The outcome of the phase is settled - exit loop
+			if r.reached(Phase1, numTrue) || r.lost(Phase1, numFalse) {
 				break
 			}
 		}
 		//Check to see if a decision was made during prepare phase
-		if r.Slots[slot.Index].Decided {
-			if r.Slots[slot.Index].Command.Tag == receive.Command.Tag {
-				r.sendCommand(vCommand)
+		if current := r.slotCopy(slot.Index); current.Decided {
+			if current.Command.Tag == receive.Command.Tag {
+				reply.Okay = true
 				return nil
 			}
 			chatf(1, "Propose: Slot already decided moving slot index to: %d", slot.Index)
 			continue
 		}
 
-		//if prepare_ok(n, na, va) from majority
-		if r.majority(numTrue) {
-			chatf(1, "Propose: Got a majority of 'true' votes from Prepare")
+		//if prepare_ok(n, na, va) from a phase 1 quorum
+		if r.reached(Phase1, numTrue) {
+			chatf(1, "Propose: Got a quorum of 'true' votes from Prepare")
+			//Recovering from a fast round collision: nothing was accepted by a proposer, so
+			//propose the fast value that may have been chosen
+			if fastCommand, ok := fastVotes.Choose(); ok && vaCommand.Command == "" {
+				chatf(1, "Propose: Recovering \"%s\" from the fast round", fastCommand.Command)
+				vaCommand = fastCommand
+			}
 			var vprime AcceptReq
 			//v' = va with highest na; choose own v otherwise
 			if vaCommand.Command != "" {
-				vprime = AcceptReq{Slot: slot.Index, Sequence: Sequence{N: highestN, Address: r.Cell[0]}, Command: vaCommand}
+				vprime = AcceptReq{Slot: slot.Index, Sequence: r.sequence(n), Command: vaCommand}
 			} else { //No highest command returned from prepare - use value passed into Propose()
-				vprime = AcceptReq{Slot: slot.Index, Sequence: Sequence{N: highestN, Address: r.Cell[0]}, Command: vCommand}
+				vprime = AcceptReq{Slot: slot.Index, Sequence: r.sequence(n), Command: vCommand}
 			}
 
 			//send accept(n, v') to all
-			acceptResponse := make(chan AcceptResp, len(r.Cell))
-			r.Mutex.RUnlock()
-			for _, address := range r.Cell {
+			acceptResponse := make(chan AcceptResp, len(cell))
+			r.proposing(slot.Index)
+			for _, address := range cell {
 				go func(address Address, accreq AcceptReq, response chan AcceptResp) {
 					recv := AcceptResp{}
 					RandLatency()
@@ -154,52 +243,42 @@ func (r *Replica) Propose(receive ProposeReq, reply *ProposeResp) error {
 					acceptResponse <- recv
 				}(address, vprime, acceptResponse)
 			}
-			r.Mutex.RLock()
 
 			numTrue = 0
 			numFalse = 0
 			//Process accept responses
-			for i := 0; i < len(r.Cell); i++ {
+			for i := 0; i < len(cell); i++ {
 				acceptResp := <-acceptResponse
 				if acceptResp.Okay {
-					numTrue++
+					numTrue += r.weight(acceptResp.Voter)
 				} else {
-					numFalse++
+					numFalse += r.weight(acceptResp.Voter)
 				}
 				if acceptResp.Promised > highestN {
 					chatf(1, "Propose: New highest n returned from accept N: %d", acceptResp.Promised)
 					highestN = acceptResp.Promised
 				}
 
-				if r.majority(numTrue) || r.majority(numFalse) {
+				if r.reached(Phase2, numTrue) || r.lost(Phase2, numFalse) {
 					break
 				}
 			}
 			//Check to see if a decision was made during accept phase
-			if r.Slots[slot.Index].Decided {
-				if r.Slots[slot.Index].Command.Tag == receive.Command.Tag {
-					r.sendCommand(vCommand)
+			if current := r.slotCopy(slot.Index); current.Decided {
+				if current.Command.Tag == receive.Command.Tag {
+					reply.Okay = true
 					return nil
 				}
 				chatf(1, "Propose: Slot already decided moving slot index to: %d", slot.Index)
 				continue
 			}
 
-			//if accept_ok(n) from majority:
-			if r.majority(numTrue) {
-				chatf(1, "Propose: Got a majority of 'true' votes from Accept")
-				r.Mutex.RUnlock()
-				//send decided(v') to all
-				for _, address := range r.Cell {
-					go func(address Address, slotIndex int, command Command) {
-						send := DecideReq{slotIndex, command}
-						recv := DecideResp{}
-						RandLatency()
-						Call(address.String(), "Replica.Decide", send, &recv)
-						RandLatency()
-					}(address, slot.Index, vprime.Command)
-				}
-				r.Mutex.RLock()
+			//if accept_ok(n) from a phase 2 quorum:
+			if r.reached(Phase2, numTrue) {
+				chatf(1, "Propose: Got a quorum of 'true' votes from Accept")
+				//send decided(v') to all, including this replica
+				r.broadcastDecide(slot.Index, vprime.Command)
+				r.Decide(DecideReq{slot.Index, vprime.Command}, &DecideResp{})
 				//Other commands need to be processed
 				if vaCommand.Tag > 0 && vaCommand.Tag != vCommand.Tag {
 					round++
@@ -208,44 +287,201 @@ func (r *Replica) Propose(receive ProposeReq, reply *ProposeResp) error {
 					break
 				}
 			} else {
-				chatf(1, "Propose: Did not get a majority of 'true' votes from Accept... restarting")
-				RandLatency(sleepTime)
-				sleepTime *= 2
+				chatf(1, "Propose: Did not get a quorum of 'true' votes from Accept... restarting")
+				sleepTime = r.backoff(sleepTime)
 				round++
 				continue
 			}
 		} else {
-			chatf(1, "Propose: Did not get a majority of 'true' votes from Prepare... restarting")
-			RandLatency(sleepTime)
-			sleepTime *= 2
+			chatf(1, "Propose: Did not get a quorum of 'true' votes from Prepare... restarting")
+			sleepTime = r.backoff(sleepTime)
 			round++
 			continue
 		}
 	}
-	r.Mutex.RUnlock()
+	reply.Okay = true
 	return nil
 }
 
-func (r *Replica) majority(n int) bool {
-	if n*2 > len(r.Cell) {
-		return true
-	}
-	return false
+//Copy of slot 'index', taken under the read lock
+func (r *Replica) slotCopy(index int) Slot {
+	r.getSlots(index)
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	return *r.slot(index)
 }
 
-func (r *Replica) sendCommand(cmd Command) {
-	commandResponse := ""
-	commandTokens := strings.Split(cmd.Command, " ")
-	if commandTokens[0] == "put" {
-		commandResponse = "[" + commandTokens[1] + "] => " + commandTokens[2] + " added to database"
-	} else if commandTokens[0] == "get" {
-		commandResponse = "[" + commandTokens[1] + "] => " + r.Database[commandTokens[1]]
-	} else if commandTokens[0] == "delete" {
-		commandResponse = "\"" + commandTokens[1] + "\" deleted from database"
+//Reserve the first slot at or after 'from' that is neither decided nor already being
+//proposed on by another local proposal, so concurrent proposals use distinct slots.
+//Waits if the membership that slot is proposed under is not known yet.
+func (r *Replica) reserveSlot(from int) int {
+	for {
+		r.ReserveMutex.Lock()
+		r.Mutex.RLock()
+		index := from
+		if index < r.Base {
+			index = r.Base
+		}
+		for (index < r.Base+len(r.Slots) && r.slot(index).Decided) || r.Reserved[index] {
+			index++
+		}
+		waiting := r.awaitingConfig(index)
+		if !waiting {
+			r.Reserved[index] = true
+		}
+		r.Mutex.RUnlock()
+		r.ReserveMutex.Unlock()
+		if !waiting {
+			return index
+		}
+		chatf(2, "Propose: Slot %d waits for the membership it is proposed under to be known", index)
+		RandLatency(5)
 	}
-	//Set a response value for the listener channel listening in main()
-	_, ok := r.Listeners[cmd.Key]
+}
+
+func (r *Replica) releaseSlot(index int) {
+	r.ReserveMutex.Lock()
+	defer r.ReserveMutex.Unlock()
+	delete(r.Reserved, index)
+}
+
+//Hand 'response' to whoever in main() is waiting on 'cmd', if they are waiting here. Only
+//the first response counts - a command decided twice is only answered once.
+func (r *Replica) respond(cmd Command, response string) {
+	r.Mutex.RLock()
+	listener, ok := r.Listeners[cmd.Key]
+	r.Mutex.RUnlock()
 	if ok {
-		r.Listeners[cmd.Key] <- commandResponse
+		select {
+		case listener <- response:
+		default:
+		}
+	}
+}
+
+//Run Paxos on slot 'index' by itself until it is decided, proposing 'command' unless a
+//value has already been accepted there. Returns the command that was decided.
+func (r *Replica) decideSlot(index int, command Command) Command {
+	sleepTime := 5 // measured in ms
+	highestN := 0
+	for {
+		r.getSlots(index)
+		r.Mutex.RLock()
+		if index < r.Base {
+			r.Mutex.RUnlock()
+			return Command{}
+		}
+		if r.slot(index).Decided {
+			decided := r.slot(index).Command
+			r.Mutex.RUnlock()
+			return decided
+		}
+		if r.slot(index).Sequence.N > highestN {
+			highestN = r.slot(index).Sequence.N
+		}
+		r.Mutex.RUnlock()
+		n := highestN + 1
+
+		//send prepare(n) to all servers including self
+		cell := r.cell()
+		response := make(chan PrepareResp, len(cell))
+		for _, address := range cell {
+			go func(address Address) {
+				send := PrepareReq{index, r.sequence(n)}
+				recv := PrepareResp{}
+				RandLatency()
+				Call(address.String(), "Replica.Prepare", send, &recv)
+				RandLatency()
+				response <- recv
+			}(address)
+		}
+		numTrue := 0
+		value := command
+		accepted := false
+		var acceptedSeq Sequence
+		fastVotes := NewFastVotes()
+		for i := 0; i < len(cell); i++ {
+			prepareResp := <-response
+			if prepareResp.Okay {
+				numTrue += r.weight(prepareResp.Voter)
+				//v' = va with highest na; choose own v otherwise
+				if prepareResp.Fast {
+					fastVotes.Add(prepareResp.Command, r.weight(prepareResp.Voter))
+				} else if prepareResp.Command.Command != "" && (!accepted || prepareResp.Accepted.Cmp(acceptedSeq) > 0) {
+					value = prepareResp.Command
+					acceptedSeq = prepareResp.Accepted
+					accepted = true
+				}
+			}
+			if prepareResp.Promised.N > highestN {
+				highestN = prepareResp.Promised.N
+			}
+		}
+		if !r.reached(Phase1, numTrue) {
+			chatf(1, "DecideSlot: Did not get a quorum of 'true' votes from Prepare on slot %d... restarting", index)
+			sleepTime = r.backoff(sleepTime)
+			continue
+		}
+		if fastCommand, ok := fastVotes.Choose(); ok && !accepted {
+			value = fastCommand
+		}
+
+		//send accept(n, v') to all
+		acceptResponse := make(chan AcceptResp, len(cell))
+		r.proposing(index)
+		for _, address := range cell {
+			go func(address Address) {
+				send := AcceptReq{Slot: index, Sequence: r.sequence(n), Command: value}
+				recv := AcceptResp{}
+				RandLatency()
+				Call(address.String(), "Replica.Accept", send, &recv)
+				RandLatency()
+				acceptResponse <- recv
+			}(address)
+		}
+		numTrue = 0
+		for i := 0; i < len(cell); i++ {
+			acceptResp := <-acceptResponse
+			if acceptResp.Okay {
+				numTrue += r.weight(acceptResp.Voter)
+			}
+			if acceptResp.Promised > highestN {
+				highestN = acceptResp.Promised
+			}
+		}
+		if !r.reached(Phase2, numTrue) {
+			chatf(1, "DecideSlot: Did not get a quorum of 'true' votes from Accept on slot %d... restarting", index)
+			sleepTime = r.backoff(sleepTime)
+			continue
+		}
+
+		//send decided(v') to everyone else - the caller records it locally
+		chatf(1, "DecideSlot: Slot %d decided as \"%s\"", index, value.Command)
+		r.broadcastDecide(index, value)
+		return value
+	}
+}
+
+//Watch for undecided slots that saw a Prepare or Accept but then went quiet for longer
+//than the no-op timeout - their proposer most likely crashed. Finish each one with a no-op
+//(or whatever value was already accepted there) so later slots are not held up behind it.
+func (r *Replica) reapAbandoned() {
+	timeout := time.Duration(*nooptimeout) * time.Millisecond
+	for {
+		time.Sleep(timeout / 2)
+		var stuck []int
+		r.Mutex.RLock()
+		for _, slot := range r.Slots {
+			if !slot.Decided && (slot.Sequence.N > 0 || slot.Accepted) && time.Since(slot.Touched) > timeout {
+				stuck = append(stuck, slot.Index)
+			}
+		}
+		r.Mutex.RUnlock()
+
+		for _, index := range stuck {
+			chatf(1, "Reaper: Slot %d has been abandoned, proposing a no-op", index)
+			command := r.decideSlot(index, NewNoOp(r.Self))
+			r.learned(index, command)
+		}
 	}
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//--- Flexible Paxos quorums ---//
+
+/*   Phase 1 (Prepare/PrepareAll) and phase 2 (Accept) need not use the same quorum, as
+     long as every phase-1 quorum intersects every phase-2 quorum:
+
+         q1 + q2 > total vote weight of the cell
+
+     A large cell can then commit with a small phase-2 quorum at the price of a larger
+     phase-1 quorum, which is only needed when a new proposer takes over.
+*/
+
+const (
+	Phase1 = 1
+	Phase2 = 2
+)
+
+//Parse a list of per-acceptor vote weights like "3410=2,192.0.2.7:3411=3". Acceptors
+//that are not listed have a weight of 1.
+func ParseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	if s == "" {
+		return weights, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("weight \"%s\" is not of the form <addr:port>=<weight>", entry)
+		}
+		address, err := ParseAddress(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("weight \"%s\" is not a whole number", parts[1])
+		}
+		weights[address.String()] = weight
+	}
+	return weights, nil
+}
+
+//Votes 'address' carries. Anyone who is not a voting member of the cell carries none.
+//Must not hold Mutex, like reached, reachedFast and lost.
+func (r *Replica) weight(address Address) int {
+	for _, member := range r.cell() {
+		if member.String() == address.String() {
+			weight, ok := r.Weights[address.String()]
+			if !ok {
+				return 1
+			}
+			return weight
+		}
+	}
+	return 0
+}
+
+//Total vote weight of 'cell'
+func (r *Replica) totalWeight(cell []Address) int {
+	total := 0
+	for _, address := range cell {
+		weight, ok := r.Weights[address.String()]
+		if !ok {
+			weight = 1
+		}
+		total += weight
+	}
+	return total
+}
+
+//Vote weight needed to finish 'phase' in a cell with 'total' vote weight. Without an
+//explicit size, both phases use a majority.
+func quorumSize(phase int, total int) int {
+	if phase == Phase1 && *quorum1 > 0 {
+		return *quorum1
+	} else if phase == Phase2 && *quorum2 > 0 {
+		return *quorum2
+	}
+	return total/2 + 1
+}
+
+//Check that phase 1 and phase 2 quorums intersect in a cell with 'total' vote weight, and
+//that both can be reached at all
+func checkQuorums(total int) error {
+	q1, q2 := quorumSize(Phase1, total), quorumSize(Phase2, total)
+	if q1 > total || q2 > total {
+		return fmt.Errorf("quorums of %d and %d votes cannot be reached with %d votes in the cell", q1, q2, total)
+	}
+	if q1+q2 <= total {
+		return fmt.Errorf("quorums of %d and %d votes do not intersect with %d votes in the cell", q1, q2, total)
+	}
+	return nil
+}
+
+//Validate the quorum configuration for the cell this replica starts with
+func (r *Replica) validateQuorums() error {
+	r.Mutex.RLock()
+	cell := r.latestConfig().Cell
+	r.Mutex.RUnlock()
+	for address := range r.Weights {
+		found := false
+		for _, member := range cell {
+			if member.String() == address {
+				found = true
+			}
+		}
+		if !found {
+			fmt.Printf("Warning: %s has a vote weight but is not a member of the cell\n", address)
+		}
+	}
+	return checkQuorums(r.totalWeight(cell))
+}
+
+//Have 'votes' been enough to finish 'phase'?
+func (r *Replica) reached(phase int, votes int) bool {
+	return votes >= quorumSize(phase, r.totalWeight(r.cell()))
+}
+
+//Vote weight a fast round needs in a cell with 'total' vote weight: enough that any two
+//fast quorums and any phase 1 quorum intersect, and any fast quorum and phase 1 quorum do
+func fastQuorumSize(total int) int {
+	q1 := quorumSize(Phase1, total)
+	size := (2*total - q1 + 2) / 2
+	if total-q1+1 > size {
+		size = total - q1 + 1
+	}
+	return size
+}
+
+//Have 'votes' been enough to decide a slot in its fast round?
+func (r *Replica) reachedFast(votes int) bool {
+	return votes >= fastQuorumSize(r.totalWeight(r.cell()))
+}
+
+//Have 'votes' against made it impossible to finish 'phase'?
+func (r *Replica) lost(phase int, votes int) bool {
+	total := r.totalWeight(r.cell())
+	return votes > total-quorumSize(phase, total)
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestCheckQuorums(t *testing.T) {
+	tests := []struct {
+		name    string
+		q1, q2  int //0 for a majority
+		total   int
+		wantErr bool
+	}{
+		{"majorities of 3", 0, 0, 3, false},
+		{"majorities of 4", 0, 0, 4, false},
+		{"majorities of 5", 0, 0, 5, false},
+		{"small phase 2, large phase 1", 4, 2, 5, false},
+		{"small phase 1, large phase 2", 1, 3, 3, false},
+		{"quorums just fail to intersect", 2, 3, 5, true},
+		{"both phases too small", 1, 1, 3, true},
+		{"phase 1 too large to reach", 4, 2, 3, true},
+		{"phase 2 too large to reach", 2, 4, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setQuorums(test.q1, test.q2)()
+			err := checkQuorums(test.total)
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkQuorums(%d) with quorums %d/%d = %v, want error %t", test.total, test.q1, test.q2, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFastQuorumIntersects(t *testing.T) {
+	tests := []struct {
+		name     string
+		q1       int //0 for a majority
+		total    int
+		wantSize int
+	}{
+		{"majority of 3", 0, 3, 3},
+		{"majority of 4", 0, 4, 3},
+		{"majority of 5", 0, 5, 4},
+		{"majority of 7", 0, 7, 6},
+		{"large phase 1 of 5", 4, 5, 4},
+		{"all of 5 in phase 1", 5, 5, 3},
+		{"small phase 1 of 5", 2, 5, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setQuorums(test.q1, 0)()
+			q1 := quorumSize(Phase1, test.total)
+			size := fastQuorumSize(test.total)
+			if size != test.wantSize {
+				t.Errorf("fastQuorumSize(%d) = %d, want %d", test.total, size, test.wantSize)
+			}
+			if size > test.total {
+				t.Errorf("fast quorum of %d cannot be reached with %d votes", size, test.total)
+			}
+			if size+q1 <= test.total {
+				t.Errorf("fast quorum of %d misses phase 1 quorum of %d with %d votes", size, q1, test.total)
+			}
+			if 2*size+q1 <= 2*test.total {
+				t.Errorf("two fast quorums of %d and phase 1 quorum of %d need not share a vote with %d votes", size, q1, test.total)
+			}
+		})
+	}
+}
+
+//Use 'q1' and 'q2' as the quorum flags, returning a func that puts the old ones back
+func setQuorums(q1, q2 int) func() {
+	old1, old2 := *quorum1, *quorum2
+	*quorum1, *quorum2 = q1, q2
+	return func() { *quorum1, *quorum2 = old1, old2 }
+}
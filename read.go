@@ -0,0 +1,152 @@
+package main
+
+import (
+	"time"
+)
+
+//--- Reads that do not go through the log ---//
+
+/*   A linearizable read has to see every write that was decided before it started. Rather
+     than deciding the read in a slot of its own, the leader asks a phase 1 quorum for the
+     highest slot each has accepted or decided. Every decided write was accepted by a phase 2
+     quorum, which shares an acceptor with the phase 1 quorum, so it is at or below the
+     highest slot reported:
+
+read(k):
+    index = highest slot accepted or decided by any of a phase 1 quorum
+    wait until every slot up to index is applied
+    return database[k]
+
+    A leader holding a lease (see lease.go) skips asking the quorum.
+
+    stale-get skips all of that and returns whatever the local database holds right now.
+*/
+
+type ReadIndexResp struct {
+	Okay  bool
+	Index int //Highest slot this acceptor has accepted or decided a value in
+	Voter Address
+}
+
+// ReadIndex() -> (okay, index):
+func (r *Replica) ReadIndex(_ Nothing, reply *ReadIndexResp) error {
+	reply.Voter = r.Self
+	if !r.isMember() {
+		reply.Okay = false
+		return nil
+	}
+	reply.Index = r.highestAccepted()
+	reply.Okay = true
+	return nil
+}
+
+type ReadReq struct {
+	Key       string
+	Forwarded bool //Already handed on by another replica - serve it here regardless
+}
+type ReadResp struct {
+	Okay     bool
+	Response string
+}
+
+// Read(key) -> (okay, response):
+//Linearizable read of 'key', served by the elected leader without using a slot
+func (r *Replica) Read(receive ReadReq, reply *ReadResp) error {
+	if !receive.Forwarded && !r.isLeader() {
+		leader := r.leader()
+		chatf(1, "Read: Forwarding read of \"%s\" to the elected leader %s", receive.Key, leader.String())
+		send := ReadReq{Key: receive.Key, Forwarded: true}
+		recv := ReadResp{}
+		RandLatency()
+		err := Call(leader.String(), "Replica.Read", send, &recv)
+		RandLatency()
+		if err == nil {
+			*reply = recv
+			return nil
+		}
+		chatf(1, "Read: Unable to reach %s, reading here: %v", leader.String(), err)
+	}
+
+	//Under a lease nobody else can get a write decided, so the grants and our own slots
+	//already cover everything a quorum would report
+	if r.holdsLease() {
+		r.waitApplied(r.leaseIndex())
+		if r.holdsLease() {
+			chatf(2, "Read: Serving \"%s\" under the leader lease", receive.Key)
+			reply.Okay = true
+			reply.Response = r.readLocal(receive.Key)
+			return nil
+		}
+		chatf(1, "Read: The leader lease lapsed while catching up, asking a quorum instead")
+	}
+
+	index, ok := r.readIndex()
+	if !ok {
+		reply.Okay = false
+		reply.Response = "Unable to reach a quorum to confirm the read"
+		return nil
+	}
+	r.waitApplied(index)
+	reply.Okay = true
+	reply.Response = r.readLocal(receive.Key)
+	return nil
+}
+
+//Highest slot a write decided before now can be in, confirmed by a phase 1 quorum
+func (r *Replica) readIndex() (int, bool) {
+	cell := r.cell()
+	response := make(chan ReadIndexResp, len(cell))
+	for _, address := range cell {
+		go func(address Address) {
+			recv := ReadIndexResp{}
+			RandLatency()
+			Call(address.String(), "Replica.ReadIndex", sendNothing, &recv)
+			RandLatency()
+			response <- recv
+		}(address)
+	}
+	numTrue := 0
+	index := -1
+	for i := 0; i < len(cell); i++ {
+		readResp := <-response
+		if !readResp.Okay {
+			continue
+		}
+		numTrue += r.weight(readResp.Voter)
+		if readResp.Index > index {
+			index = readResp.Index
+		}
+	}
+	if !r.reached(Phase1, numTrue) {
+		chatf(1, "Read: Did not get a quorum of answers to ReadIndex")
+		return 0, false
+	}
+	return index, true
+}
+
+//Wait until every slot up to 'index' has been applied, going after any that are missing
+func (r *Replica) waitApplied(index int) {
+	var catchup time.Time
+	for {
+		r.Mutex.RLock()
+		applied := r.Applied
+		r.Mutex.RUnlock()
+		if applied >= index {
+			return
+		}
+		//Try again every so often: a catch-up already running when we asked does nothing,
+		//and the one running may stop short of 'index'
+		if time.Since(catchup) > CatchupDelay {
+			go r.fillGaps(index + 1)
+			catchup = time.Now()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//Value of 'key' in the local database, formatted the way 'get' answers
+func (r *Replica) readLocal(key string) string {
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	return "[" + key + "] => " + r.Database[key]
+}
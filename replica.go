@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 //--- Replica data structures and methods that are not directly part of
@@ -29,15 +33,18 @@ func (a *Address) Print() {
 
 // SLOT STRUCT AND METHODS
 type Slot struct {
-	Index    int
-	Sequence Sequence
-	Command  Command
-	Accepted bool
-	Decided  bool
+	Index       int
+	Sequence    Sequence //Highest sequence promised
+	AcceptedSeq Sequence //Sequence Command was accepted at, which later promises do not change
+	Command     Command
+	Accepted    bool
+	Decided     bool
+	Fast        bool      //Command was accepted in the slot's fast round
+	Touched     time.Time //Last Prepare or Accept seen for this slot
 }
 
 func (s *Slot) String() string {
-	return fmt.Sprintf("Index: %d, Sequence: %d, Command: %d, Accepted: %t, Decided: %t", s.Index, s.Sequence.String(), s.Command.String, s.Accepted, s.Decided)
+	return fmt.Sprintf("Index: %d, Sequence: %s, Command: %s, Accepted: %t, Decided: %t", s.Index, s.Sequence.String(), s.Command.String(), s.Accepted, s.Decided)
 }
 func (s *Slot) Print() {
 	fmt.Println(s.String())
@@ -47,6 +54,7 @@ func (s *Slot) Print() {
 type Sequence struct {
 	N       int
 	Address Address
+	ID      int //Node ID of the replica at Address, which breaks ties between equal N
 }
 
 func (s *Sequence) String() string {
@@ -61,9 +69,9 @@ func (this *Sequence) Cmp(that Sequence) int {
 	} else if this.N > that.N {
 		return 1
 	} else {
-		if this.Address.IP < that.Address.IP {
+		if this.ID < that.ID {
 			return -1
-		} else if this.Address.IP > that.Address.IP {
+		} else if this.ID > that.ID {
 			return 1
 		}
 		return 0
@@ -71,12 +79,24 @@ func (this *Sequence) Cmp(that Sequence) int {
 }
 
 // COMMAND STRUCT AND METHODS
+
+//Command used to fill a slot that has to be decided but has nothing useful to carry
+const NoOp = "noop"
+
+//Build a no-op command proposed by the replica at 'address'
+func NewNoOp(address Address) Command {
+	return Command{Command: NoOp, Address: address, Promise: Sequence{N: 0, Address: address}, Tag: rand.Int()}
+}
+
 type Command struct {
-	Promise Sequence
-	Command string
-	Address Address
-	Tag     int
-	Key     string
+	Promise   Sequence
+	Command   string
+	Address   Address
+	Tag       int
+	Key       string
+	Batch     []Command //Commands decided together in one slot
+	Client    string    //Session the command was sent in, "" for commands outside of any session
+	ClientSeq int       //Request number within the session - retries keep the same number
 }
 
 func (c *Command) String() string {
@@ -88,43 +108,194 @@ func (c *Command) Print() {
 func (this *Command) Equal(that Command) bool {
 	return this.Promise.Cmp(that.Promise) == 0 && this.Tag == that.Tag
 }
+func (c *Command) IsNoOp() bool {
+	return c.Command == NoOp
+}
+func (c *Command) IsBatch() bool {
+	return c.Command == BatchCommand
+}
+
+//The commands to apply for this command, in order - a batch stands for everything in it
+func (c *Command) Commands() []Command {
+	if c.IsBatch() {
+		return c.Batch
+	}
+	return []Command{*c}
+}
 
 //REPLICA STRUCT AND METHODS
 type Replica struct {
-	Cell      []Address //Cell[0] must always be the local address/port
-	Slots     []Slot
-	Database  map[string]string
-	Listeners map[string]chan string
-	Mutex     sync.RWMutex
+	Self          Address        //Address of this replica, which never changes
+	Cell          []Address      //Voting members of the cell, guarded by Mutex like Member and Pending
+	ID            int            //Node ID that makes this replica's ballots unique
+	Member        bool           //False for learners and once this replica has been removed from the cell
+	Learners      []Address      //Non-voting replicas that are sent every decision, this one among them if it is a learner
+	Weights       map[string]int //Vote weight of each acceptor that does not have the default of 1
+	Pending       []Config       //Membership changes decided but not in effect yet
+	Epoch         int            //Number of membership changes that have taken effect
+	Slots         []Slot         //Slots[0] is slot number Base
+	Base          int            //Slots before Base have been compacted into the snapshot
+	Applied       int            //Highest slot applied to Database
+	Database      map[string]string
+	Keys          []string          //Every key in Database, sorted
+	Expiries      map[string]Expiry //TTLs of the keys that have one
+	Changes       []Change          //Recent changes to Database, kept for watchers
+	ChangesFrom   int               //Every change from this slot on is still in Changes
+	ChangeSignal  chan Nothing      //Closed whenever a change is recorded
+	Listeners     map[string]chan string
+	Sessions      map[string]Session        //Latest request applied from each client session
+	SessionClock  int                       //Requests applied in any session, used to expire old sessions
+	Instances     map[InstanceID]*Instance  //EPaxos instances not yet executed into a snapshot
+	Executed      map[string]Executed       //EPaxos instances reflected in the last snapshot, by command leader
+	Executions    int                       //EPaxos instances executed since the last snapshot
+	NextInstance  int                       //Next EPaxos instance this replica will lead
+	KeyInstances  map[string]map[string]int //Latest EPaxos instance on each key or session from each leader
+	KeySeq        map[string]int            //Highest EPaxos seq on each key or session
+	Ballot        Sequence                  //Acceptor promise covering every slot from BallotFrom on
+	BallotFrom    int
+	Leading       bool             //This replica is the Multi-Paxos leader
+	LeaderBallot  Sequence         //Sequence this replica leads with
+	LeaderEpoch   int              //Membership epoch the leader's PrepareAll was answered in
+	NextSlot      int              //Next slot the leader will propose on
+	NextOwned     int              //Mencius: no slot of ours before this one is unused
+	Owned         int              //Mencius: highest slot of ours we have proposed on, as logged
+	HighestN      int              //Highest sequence number seen from any proposer. Guarded by HighestMutex.
+	Reserved      map[int]bool     //Slots local proposals are currently working on
+	Window        chan Nothing     //Bounds the number of local proposals in flight
+	Batch         *PendingBatch    //Commands collected for the next batch
+	Peers         map[string]*Peer //Failure detector's view of the other members
+	LeaseHolder   Address          //Replica this one has granted the lease to
+	LeaseExpires  time.Time        //When that grant runs out, by the local clock
+	LeaseIndex    int              //Highest slot any grantor had accepted when granting us the lease. Guarded by PeerMutex.
+	Proposed      int              //Highest slot this replica has sent an Accept for. Guarded by PeerMutex.
+	WAL           *WAL
+	Incoming      *bytes.Buffer   //Snapshot chunks received so far from a peer
+	Sending       map[string]bool //Peers we are currently sending a snapshot to
+	Mutex         sync.RWMutex    //Write lock to change Slots, Base, acceptor state or Applied, read lock to look at them
+	ApplyMutex    sync.Mutex      //Serializes applying decided slots and taking snapshots
+	SendingMutex  sync.Mutex
+	CatchupMutex  sync.Mutex //Held while filling gaps in the decided slots
+	LeaderMutex   sync.Mutex //Serializes becoming leader and handing out leader slots
+	ReserveMutex  sync.Mutex
+	BatchMutex    sync.Mutex
+	PeerMutex     sync.Mutex
+	LeaseMutex    sync.Mutex //Guards the lease this replica has granted
+	InstanceMutex sync.Mutex //Guards the EPaxos instance state
+	MenciusMutex  sync.Mutex //Serializes handing out and skipping owned slots
+	HighestMutex  sync.Mutex //Guards HighestN, which every proposer goroutine raises
+}
+
+//Turn "addr:port", ":port" or just "port" into an Address
+func ParseAddress(s string) (Address, error) {
+	//If no colon is found, assume number given is a port and prepend colon to it
+	if !strings.Contains(s, ":") {
+		s = ":" + s
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Address{}, err
+	}
+	//If host is empty assume user was refering to port on local address
+	if host == "" {
+		host = GetLocalAddress()
+	}
+	return Address{IP: host, Port: port}, nil
+}
+
+//Node ID for the replica at 'address': the -id flag if given, otherwise one derived from
+//the address so that it stays the same across restarts
+func NodeID(address Address) int {
+	if *nodeid > 0 {
+		return *nodeid
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(address.String()))
+	return int(hash.Sum32()&0x7fffffff) + 1
 }
 
 func CreateReplica(cell []string) *Replica {
 	var addresses []Address
 	//Format and insert addresses passed in from command line to Address{} structs
 	for _, v := range cell {
-		host, port, err := net.SplitHostPort(v)
+		address, err := ParseAddress(v)
 		if err != nil {
 			fmt.Println(err)
 		}
-		//If host is empty assume user was refering to port on local address
-		if host == "" {
-			host = GetLocalAddress()
-		}
-		addresses = append(addresses, Address{IP: host, Port: port})
+		addresses = append(addresses, address)
 	}
 
 	fmt.Println("Creating RPC server for new node...")
-	return &Replica{
-		Cell:      addresses,
-		Database:  make(map[string]string),
-		Listeners: make(map[string]chan string)}
+	r := &Replica{
+		Self:         addresses[0],
+		Cell:         addresses,
+		ID:           NodeID(addresses[0]),
+		Member:       !*learner,
+		Applied:      -1,
+		Owned:        -1,
+		LeaseIndex:   -1,
+		Proposed:     -1,
+		Database:     make(map[string]string),
+		Expiries:     make(map[string]Expiry),
+		ChangeSignal: make(chan Nothing),
+		Listeners:    make(map[string]chan string),
+		Sessions:     make(map[string]Session),
+		Instances:    make(map[InstanceID]*Instance),
+		Executed:     make(map[string]Executed),
+		KeyInstances: make(map[string]map[string]int),
+		KeySeq:       make(map[string]int),
+		Sending:      make(map[string]bool),
+		Peers:        make(map[string]*Peer),
+		Reserved:     make(map[int]bool),
+		Window:       make(chan Nothing, *window)}
+
+	//A learner is given the addresses of the voting members after its own
+	if *learner {
+		r.Cell = addresses[1:]
+	}
+
+	voteWeights, err := ParseWeights(*weights)
+	if err != nil {
+		log.Fatal("CreateReplica: Unable to parse vote weights:", err)
+	}
+	r.Weights = voteWeights
+
+	//Start from the newest snapshot, if there is one
+	snap, err := LoadSnapshot(SnapshotPath(*datadir, addresses[0]))
+	if err != nil {
+		log.Fatal("CreateReplica: Unable to load snapshot:", err)
+	}
+	if snap != nil {
+		r.Database = snap.Database
+		r.indexKeys()
+		r.Base = snap.Slot + 1
+		r.Applied = snap.Slot
+		if len(snap.Cell) > 0 {
+			r.setConfig(Config{Cell: snap.Cell, Learners: snap.Learners})
+			r.Pending = snap.Pending
+		}
+		r.setExecuted(snap.Executed)
+		r.setSessions(snap.Sessions)
+		r.setExpiries(snap.Expiries)
+		r.ChangesFrom = r.Base
+		fmt.Printf("Snapshot: restored %d database items through slot %d\n", len(snap.Database), snap.Slot)
+	}
+
+	//Recover whatever this replica promised, accepted, and learned before it last stopped
+	wal, entries, err := OpenWAL(WALPath(*datadir, addresses[0]))
+	if err != nil {
+		log.Fatal("CreateReplica: Unable to open write-ahead log:", err)
+	}
+	r.WAL = wal
+	r.replay(entries)
+	fmt.Printf("Write-ahead log: %s (%d entries replayed)\n", wal.Path, len(entries))
+	return r
 }
 
 func Listen(r *Replica) {
 	rpc.Register(r)
 	rpc.HandleHTTP()
-	fmt.Printf("RPC server is listening on port: %s\n", r.Cell[0].String())
-	l, e := net.Listen("tcp", ":"+r.Cell[0].Port)
+	fmt.Printf("RPC server is listening on port: %s\n", r.Self.String())
+	l, e := net.Listen("tcp", ":"+r.Self.Port)
 	if e != nil {
 		log.Fatal("Listen: Listen error:", e)
 	}
@@ -136,41 +307,191 @@ func (r *Replica) Ping(_ Nothing, reply *int) error {
 	return nil
 }
 
+type IdentifyReq struct {
+	From Address
+	ID   int
+}
+type IdentifyResp struct {
+	ID int
+}
+
+//Identify(from, id) -> (id):
+//Swap node IDs with another replica so that both can check they are not the same
+func (r *Replica) Identify(receive IdentifyReq, reply *IdentifyResp) error {
+	reply.ID = r.ID
+	if receive.ID == r.ID && receive.From.String() != r.Self.String() {
+		log.Printf("Identify: %s is using this replica's node ID %d", receive.From.String(), r.ID)
+	}
+	return nil
+}
+
+//Make sure no other replica in the cell that is up right now has our node ID. Replicas
+//that are down run the same check against us when they start.
+func (r *Replica) checkNodeIDs() error {
+	for _, address := range r.everyoneElse() {
+		send := IdentifyReq{From: r.Self, ID: r.ID}
+		recv := IdentifyResp{}
+		if err := Call(address.String(), "Replica.Identify", send, &recv); err != nil {
+			continue
+		}
+		if recv.ID == r.ID {
+			return fmt.Errorf("%s already uses node ID %d", address.String(), r.ID)
+		}
+	}
+	return nil
+}
+
 func (r *Replica) Dump(_ Nothing, reply *string) error {
+	//Both take the read lock themselves
+	leader := r.leader()
+	leaseExpiry := r.leaseExpiry()
+	//The database, keys, expiries and sessions are only changed under ApplyMutex
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
 	r.Mutex.RLock()
 	defer r.Mutex.RUnlock()
 	i := 0
 	var buffer bytes.Buffer
 	buffer.WriteString("\nCell Addresses:    \n")
-	for _, cell := range r.Cell {
+	others, _ := without(r.Cell, r.Self.String())
+	for _, cell := range append([]Address{r.Self}, others...) {
+		status := ""
+		if cell.String() == leader.String() {
+			status = " [elected leader]"
+		}
+		if weight, ok := r.Weights[cell.String()]; ok {
+			status += fmt.Sprintf(" [weight %d]", weight)
+		}
 		if i == 0 {
-			buffer.WriteString("     " + cell.String() + " (Local replica address)\n")
+			buffer.WriteString("     " + cell.String() + " (Local replica address)" + status + "\n")
+		} else if r.alive(cell) {
+			buffer.WriteString("     " + cell.String() + " (alive)" + status + "\n")
 		} else {
-			buffer.WriteString("     " + cell.String() + "\n")
+			buffer.WriteString("     " + cell.String() + " (suspected)" + status + "\n")
 		}
 		i++
 	}
+	for _, address := range r.Learners {
+		if address.String() != r.Self.String() {
+			buffer.WriteString("     " + address.String() + " (learner)\n")
+		}
+	}
+	if !r.Member {
+		buffer.WriteString("     This replica is not a voting member of the cell\n")
+	}
+	total := r.totalWeight(r.members())
+	buffer.WriteString(fmt.Sprintf("Quorums: phase 1 needs %d, phase 2 needs %d of %d votes\n", quorumSize(Phase1, total), quorumSize(Phase2, total), total))
+	if r.Ballot.N > 0 {
+		buffer.WriteString(fmt.Sprintf("\nPromised to all slots from %d: N: %d/%s\n", r.BallotFrom, r.Ballot.N, r.Ballot.Address.String()))
+	}
+	if r.Leading {
+		buffer.WriteString(fmt.Sprintf("Leading with N: %d, next slot: %d\n", r.LeaderBallot.N, r.NextSlot))
+	}
+	if *lease > 0 {
+		if time.Now().Before(leaseExpiry) {
+			buffer.WriteString(fmt.Sprintf("Holding the leader lease for another %v\n", time.Until(leaseExpiry).Round(time.Millisecond)))
+		}
+		r.LeaseMutex.Lock()
+		if time.Now().Before(r.LeaseExpires) {
+			buffer.WriteString("Lease granted to " + r.LeaseHolder.String() + "\n")
+		}
+		r.LeaseMutex.Unlock()
+	}
+	for _, config := range r.Pending {
+		buffer.WriteString(fmt.Sprintf("Pending membership from slot %d: %d members\n", config.From, len(config.Cell)))
+	}
+	r.InstanceMutex.Lock()
+	if len(r.Instances) > 0 || len(r.Executed) > 0 {
+		var ids []InstanceID
+		for id := range r.Instances {
+			ids = append(ids, id)
+		}
+		sortInstances(ids)
+		buffer.WriteString("\nInstances:    \n")
+		for _, id := range ids {
+			instance := r.Instances[id]
+			if instance.Status == StatusExecuted {
+				continue
+			}
+			buffer.WriteString(fmt.Sprintf("     [%s]=>\"%s\" Seq: %d Deps: %v Status: %s\n", id.String(), instance.Command.Command, instance.Seq, instance.Deps, statusNames[instance.Status]))
+		}
+		executed := r.Executions
+		for _, watermark := range r.Executed {
+			executed += watermark.count()
+		}
+		buffer.WriteString(fmt.Sprintf("     # Instances executed: %d\n", executed))
+	}
+	r.InstanceMutex.Unlock()
 	buffer.WriteString("\nSlots:    \n")
 	for _, Slot := range r.Slots {
 		buffer.WriteString(fmt.Sprintf("     [%d]=>\"%s\" N: %d/%s Accepted: %t Decided: %t\n", Slot.Index, Slot.Command.Command, Slot.Sequence.N, Slot.Sequence.Address.String(), Slot.Accepted, Slot.Decided))
+		for _, command := range Slot.Command.Batch {
+			buffer.WriteString(fmt.Sprintf("          \"%s\"\n", command.Command))
+		}
 		i++
 	}
 	buffer.WriteString("\n     # Slots filled: " + strconv.Itoa(len(r.Slots)) + "\n")
+	buffer.WriteString("     # Slots compacted: " + strconv.Itoa(r.Base) + "\n")
+	buffer.WriteString("     Last applied slot: " + strconv.Itoa(r.Applied) + "\n")
 	buffer.WriteString("\nDatabase:        \n")
-	for k, v := range r.Database {
+	for _, k := range r.Keys {
+		v := r.Database[k]
+		if expiry, ok := r.Expiries[k]; ok {
+			v += " (ttl " + expiry.TTL.String() + ")"
+		}
 		buffer.WriteString("     [" + k + "]: " + v + "\n")
 	}
 	buffer.WriteString("\n     # Database items: " + strconv.Itoa(len(r.Database)) + "\n")
+	buffer.WriteString("     # Client sessions: " + strconv.Itoa(len(r.Sessions)) + "\n")
 	*reply = buffer.String()
 
 	return nil
 }
 
-//Make sure slots exist up to 'n', but will not overwrite any existing slots
+//Ballot 'n' proposed by this replica
+func (r *Replica) sequence(n int) Sequence {
+	return Sequence{N: n, Address: r.Self, ID: r.ID}
+}
+
+//Highest sequence number seen from any proposer
+func (r *Replica) highestN() int {
+	r.HighestMutex.Lock()
+	defer r.HighestMutex.Unlock()
+	return r.HighestN
+}
+
+//Raise HighestN to 'n' if a proposer has been seen using a higher sequence number
+func (r *Replica) sawN(n int) {
+	r.HighestMutex.Lock()
+	defer r.HighestMutex.Unlock()
+	if n > r.HighestN {
+		r.HighestN = n
+	}
+}
+
+//Make sure slots exist up to 'n', but will not overwrite any existing slots. Must not
+//hold Mutex: adding slots can move them, so it takes the write lock.
 func (r *Replica) getSlots(n int) {
-	for i := len(r.Slots); i <= n; i++ {
-		sequence := Sequence{N: 0, Address: r.Cell[0]}
+	r.Mutex.RLock()
+	enough := n < r.Base+len(r.Slots)
+	r.Mutex.RUnlock()
+	if enough {
+		return
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	for i := r.Base + len(r.Slots); i <= n; i++ {
+		sequence := Sequence{N: 0, Address: r.Self}
 		slot := Slot{Index: i, Sequence: sequence, Command: Command{}, Accepted: false, Decided: false}
 		r.Slots = append(r.Slots, slot)
 	}
 }
+
+//Slot number 'n'. Slots before Base have been compacted away, so a decided placeholder
+//is returned for them instead.
+func (r *Replica) slot(n int) *Slot {
+	if n < r.Base {
+		return &Slot{Index: n, Decided: true}
+	}
+	return &r.Slots[n-r.Base]
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSequenceCmp(t *testing.T) {
+	low := Address{IP: "127.0.0.1", Port: "3410"}
+	high := Address{IP: "127.0.0.1", Port: "3412"}
+	tests := []struct {
+		name string
+		this Sequence
+		that Sequence
+		want int
+	}{
+		{"lower number", Sequence{N: 1, Address: high, ID: 9}, Sequence{N: 2, Address: low, ID: 1}, -1},
+		{"higher number", Sequence{N: 3, Address: low, ID: 1}, Sequence{N: 2, Address: high, ID: 9}, 1},
+		{"same number, lower node ID", Sequence{N: 2, Address: high, ID: 1}, Sequence{N: 2, Address: low, ID: 2}, -1},
+		{"same number, higher node ID", Sequence{N: 2, Address: low, ID: 2}, Sequence{N: 2, Address: high, ID: 1}, 1},
+		{"same number and node ID", Sequence{N: 2, Address: low, ID: 1}, Sequence{N: 2, Address: low, ID: 1}, 0},
+		{"zero values", Sequence{}, Sequence{}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.this.Cmp(test.that); got != test.want {
+				t.Errorf("Cmp(%v, %v) = %d, want %d", test.this, test.that, got, test.want)
+			}
+			//Every pair of ballots is ordered the same way from either side
+			if got := test.that.Cmp(test.this); got != -test.want {
+				t.Errorf("Cmp(%v, %v) = %d, want %d", test.that, test.this, got, -test.want)
+			}
+		})
+	}
+}
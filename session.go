@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+)
+
+//--- Client sessions ---//
+
+/*   Every client numbers its requests 1, 2, 3... within a session. A retry of a request
+     keeps its number, so when the same request gets decided twice - a client retry, or a
+     proposer that re-proposed it on another slot - the second copy is recognized and
+     answered with the response from the first instead of being applied again.
+
+     Sessions are part of the replicated state: every replica applies the same commands in
+     the same order and so reaches the same decisions about what is a duplicate.
+*/
+
+//Most sessions remembered at once. The least recently used one is forgotten first.
+const MaxSessions = 1024
+
+type Session struct {
+	Seq      int    //Highest request number applied from the client
+	Response string //Response to that request
+	LastUsed int    //Value of SessionClock when the session last applied a request
+}
+
+//Apply 'command' unless its session shows it has been applied already, in which case the
+//response from the first time is returned instead. Must hold ApplyMutex.
+func (r *Replica) applyOnce(index int, command Command) string {
+	if command.Client == "" {
+		return r.apply(index, command)
+	}
+	session, ok := r.Sessions[command.Client]
+	if ok && command.ClientSeq == session.Seq {
+		chatf(1, "Session: Request %d from %s was already applied, returning the saved response", command.ClientSeq, command.Client)
+		return session.Response
+	}
+	if ok && command.ClientSeq < session.Seq {
+		chatf(1, "Session: Request %d from %s is older than request %d", command.ClientSeq, command.Client, session.Seq)
+		return "Request has been superseded by a later request from the same client"
+	}
+	commandResponse := r.apply(index, command)
+	r.SessionClock++
+	r.Sessions[command.Client] = Session{Seq: command.ClientSeq, Response: commandResponse, LastUsed: r.SessionClock}
+	if len(r.Sessions) > MaxSessions {
+		r.expireSessions()
+	}
+	return commandResponse
+}
+
+//Forget the least recently used sessions until there are MaxSessions left. A client whose
+//session is forgotten starts over as if it were new.
+func (r *Replica) expireSessions() {
+	var clients []string
+	for client := range r.Sessions {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return r.Sessions[clients[i]].LastUsed < r.Sessions[clients[j]].LastUsed
+	})
+	for _, client := range clients[:len(clients)-MaxSessions] {
+		delete(r.Sessions, client)
+	}
+}
+
+//Make 'sessions' the session table, after a snapshot has been loaded or installed
+func (r *Replica) setSessions(sessions map[string]Session) {
+	r.Sessions = make(map[string]Session)
+	r.SessionClock = 0
+	for client, session := range sessions {
+		r.Sessions[client] = session
+		if session.LastUsed > r.SessionClock {
+			r.SessionClock = session.LastUsed
+		}
+	}
+}
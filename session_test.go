@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestApplyOnce(t *testing.T) {
+	put := func(client string, seq int, key, value string) Command {
+		return Command{Command: "put " + key + " " + value, Client: client, ClientSeq: seq}
+	}
+	added := func(key, value string) string {
+		return "[" + key + "] => " + value + " added to database"
+	}
+	steps := []struct {
+		name         string
+		command      Command
+		wantResponse string
+		wantValue    string //Value of the command's key afterwards
+	}{
+		{"first request", put("c1", 1, "a", "1"), added("a", "1"), "1"},
+		{"retry is answered from the session", put("c1", 1, "a", "2"), added("a", "1"), "1"},
+		{"next request is applied", put("c1", 2, "a", "3"), added("a", "3"), "3"},
+		{"older request is refused", put("c1", 1, "a", "4"), "Request has been superseded by a later request from the same client", "3"},
+		{"another client has its own numbering", put("c2", 1, "a", "5"), added("a", "5"), "5"},
+		{"retry after another client wrote", put("c1", 2, "a", "6"), added("a", "3"), "5"},
+		{"commands without a session always apply", put("", 0, "a", "7"), added("a", "7"), "7"},
+		{"and are never deduplicated", put("", 0, "a", "7"), added("a", "7"), "7"},
+	}
+	r := newTestReplica(t, t.TempDir())
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	for i, step := range steps {
+		if got := r.applyOnce(i, step.command); got != step.wantResponse {
+			t.Errorf("%s: got response %q, want %q", step.name, got, step.wantResponse)
+		}
+		if got := r.Database["a"]; got != step.wantValue {
+			t.Errorf("%s: a is %q, want %q", step.name, got, step.wantValue)
+		}
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	r := newTestReplica(t, t.TempDir())
+	r.ApplyMutex.Lock()
+	defer r.ApplyMutex.Unlock()
+	for i := 0; i <= MaxSessions; i++ {
+		client := "c" + strconv.Itoa(i)
+		r.applyOnce(i, Command{Command: "put " + client + " 1", Client: client, ClientSeq: 1})
+		//Touch the first client again so the second becomes the least recently used
+		if i == 1 {
+			r.applyOnce(i, Command{Command: "put c0 2", Client: "c0", ClientSeq: 2})
+		}
+	}
+	if len(r.Sessions) != MaxSessions {
+		t.Errorf("%d sessions remembered, want %d", len(r.Sessions), MaxSessions)
+	}
+	if _, ok := r.Sessions["c1"]; ok {
+		t.Errorf("least recently used session was kept")
+	}
+	if _, ok := r.Sessions["c0"]; !ok {
+		t.Errorf("recently used session was forgotten")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//--- State machine snapshots and log compaction ---//
+
+type Snapshot struct {
+	Slot     int //Last slot whose command is reflected in Database
+	Database map[string]string
+	Cell     []Address           //Members of the cell as of Slot
+	Learners []Address           //Non-voting replicas as of Slot
+	Pending  []Config            //Membership changes decided by Slot but not yet in effect
+	Executed map[string]Executed //EPaxos instances reflected in Database, by command leader
+	Sessions map[string]Session  //Client sessions as of Slot
+	Expiries map[string]Expiry   //TTLs of keys in Database
+}
+
+//Name of the snapshot file for the replica listening on 'address'
+func SnapshotPath(dir string, address Address) string {
+	return filepath.Join(dir, "paxos-"+address.IP+"-"+address.Port+".snap")
+}
+
+//Read the snapshot at 'path'. Returns nil without an error if no snapshot has been taken yet.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, err
+	}
+	if snap.Database == nil {
+		snap.Database = make(map[string]string)
+	}
+	return snap, nil
+}
+
+//Atomically replace the snapshot at 'path' with 'snap'
+func WriteSnapshot(path string, snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+//Have enough slots been applied, or has the log grown large enough, to be worth a snapshot?
+func (r *Replica) snapshotDue() bool {
+	//Nothing has been applied or executed since the last snapshot
+	if r.Applied < r.Base && r.Executions == 0 {
+		return false
+	}
+	if *snapslots > 0 && r.Applied-r.Base+1 >= *snapslots {
+		return true
+	}
+	if *snapbytes > 0 && r.WAL != nil && r.WAL.Len() >= int64(*snapbytes) {
+		return true
+	}
+	return false
+}
+
+//Snapshot the database as of the last applied slot, then drop every slot it covers.
+//Must be called with ApplyMutex held so the database does not change underneath it.
+func (r *Replica) takeSnapshot() {
+	r.Mutex.RLock()
+	snap := &Snapshot{Slot: r.Applied, Database: r.Database, Cell: r.members(), Learners: r.Learners, Pending: r.Pending, Sessions: r.Sessions, Expiries: r.Expiries}
+	r.Mutex.RUnlock()
+	snap.Executed = r.executedInstances()
+	if err := WriteSnapshot(SnapshotPath(*datadir, r.Self), snap); err != nil {
+		log.Println("Snapshot: Unable to write snapshot:", err)
+		return
+	}
+	chatf(1, "Snapshot: Saved %d database items through slot %d", len(r.Database), r.Applied)
+	r.setExecuted(snap.Executed)
+	r.Executions = 0
+	r.compact(r.Applied)
+}
+
+//Forget slots up through 'n' and rewrite the log so it only covers the slots that remain.
+//The snapshot covering those slots must already be on disk. Must hold ApplyMutex but not Mutex.
+func (r *Replica) compact(n int) {
+	//Everyone else reads Slots and Base under the read lock. Keep it through the rewrite so
+	//no promise or accept lands in memory without making it into the new log.
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	//Still rewrite the log when only EPaxos instances were executed into the snapshot
+	if n >= r.Base {
+		if n-r.Base+1 >= len(r.Slots) {
+			r.Slots = nil
+		} else {
+			r.Slots = append([]Slot(nil), r.Slots[n-r.Base+1:]...)
+		}
+		r.Base = n + 1
+	}
+
+	if r.WAL == nil {
+		return
+	}
+	if err := r.WAL.Rewrite(r.slotEntries); err != nil {
+		//The old log is still intact and is a superset of what we wanted to keep
+		log.Println("Snapshot: Unable to compact write-ahead log:", err)
+		return
+	}
+	chatf(1, "Snapshot: Compacted log through slot %d, %d slots remain", n, len(r.Slots))
+}
+
+//--- Snapshot transfer to lagging replicas ---//
+
+//Largest piece of a snapshot sent in a single InstallSnapshot call
+const SnapshotChunk = 64 * 1024
+
+type InstallSnapshotReq struct {
+	Slot   int    //Last slot covered by the snapshot
+	Offset int    //Position of Data within the encoded snapshot
+	Data   []byte //Piece of the encoded snapshot
+	Done   bool   //This is the last piece
+}
+type InstallSnapshotResp struct {
+	Okay    bool
+	Applied int //Highest slot the receiver has applied
+}
+
+//InstallSnapshot(slot, offset, data, done) -> (okay, applied):
+//Receive one chunk of a peer's snapshot. Once the last chunk arrives, the snapshot replaces
+//our database if it is ahead of what we have already applied.
+func (r *Replica) InstallSnapshot(receive InstallSnapshotReq, reply *InstallSnapshotResp) error {
+	r.ApplyMutex.Lock()
+
+	reply.Applied = r.Applied
+	//A snapshot through the slot we have applied can still hold EPaxos instances we missed
+	if receive.Slot < r.Applied || (receive.Slot == r.Applied && !*epaxos) {
+		chatf(2, "InstallSnapshot: Already applied through slot %d, ignoring snapshot through slot %d", r.Applied, receive.Slot)
+		r.Incoming = nil
+		r.ApplyMutex.Unlock()
+		reply.Okay = false
+		return nil
+	}
+	//A new transfer is starting, or a chunk went missing and the sender must start over
+	if receive.Offset == 0 {
+		r.Incoming = new(bytes.Buffer)
+	}
+	if r.Incoming == nil || r.Incoming.Len() != receive.Offset {
+		chatf(2, "InstallSnapshot: Unexpected chunk at offset %d", receive.Offset)
+		r.Incoming = nil
+		r.ApplyMutex.Unlock()
+		reply.Okay = false
+		return nil
+	}
+	r.Incoming.Write(receive.Data)
+	reply.Okay = true
+	if !receive.Done {
+		r.ApplyMutex.Unlock()
+		return nil
+	}
+
+	snap := &Snapshot{}
+	err := json.Unmarshal(r.Incoming.Bytes(), snap)
+	r.Incoming = nil
+	if err != nil {
+		log.Println("InstallSnapshot: Unable to decode snapshot:", err)
+		r.ApplyMutex.Unlock()
+		reply.Okay = false
+		return nil
+	}
+	if snap.Database == nil {
+		snap.Database = make(map[string]string)
+	}
+	//Instances executed into our own snapshot cannot be run again, so the new one has to
+	//hold them all, and it has to bring something we do not have
+	executed := r.executedInstances()
+	r.InstanceMutex.Lock()
+	compacted := coversExecuted(snap.Executed, r.Executed)
+	r.InstanceMutex.Unlock()
+	if !compacted || (snap.Slot == r.Applied && coversExecuted(executed, snap.Executed)) {
+		chatf(2, "InstallSnapshot: Snapshot through slot %d is not ahead of what has been executed here", snap.Slot)
+		r.ApplyMutex.Unlock()
+		reply.Okay = false
+		return nil
+	}
+	if err := WriteSnapshot(SnapshotPath(*datadir, r.Self), snap); err != nil {
+		log.Println("InstallSnapshot: Unable to write snapshot:", err)
+		r.ApplyMutex.Unlock()
+		reply.Okay = false
+		return nil
+	}
+	r.Database = snap.Database
+	r.indexKeys()
+	r.Mutex.Lock()
+	r.Applied = snap.Slot
+	r.setExecuted(snap.Executed)
+	r.setSessions(snap.Sessions)
+	r.setExpiries(snap.Expiries)
+	r.resetChanges(snap.Slot)
+	if len(snap.Cell) > 0 {
+		r.setConfig(Config{Cell: snap.Cell, Learners: snap.Learners})
+		r.Pending = snap.Pending
+	}
+	r.Mutex.Unlock()
+	r.compact(snap.Slot)
+	reply.Applied = r.Applied
+	chatf(1, "InstallSnapshot: Installed snapshot with %d database items through slot %d", len(snap.Database), snap.Slot)
+	r.ApplyMutex.Unlock()
+
+	//Slots decided after the snapshot may now be ready to apply
+	r.applyDecided()
+	r.executeInstances()
+	return nil
+}
+
+type RequestSnapshotReq struct {
+	Address  Address             //Replica that wants the snapshot
+	Applied  int                 //Highest slot it has applied
+	Executed map[string]Executed //EPaxos instances it has executed
+}
+
+//RequestSnapshot(address, applied):
+//Ask this replica to send its latest snapshot to a replica that has fallen behind
+func (r *Replica) RequestSnapshot(receive RequestSnapshotReq, reply *bool) error {
+	*reply = false
+	r.Mutex.RLock()
+	ahead := r.Base-1 > receive.Applied
+	level := r.Base-1 == receive.Applied
+	r.Mutex.RUnlock()
+	//EPaxos instances are not in slots - the snapshot can be ahead by instances alone
+	if *epaxos && level {
+		r.InstanceMutex.Lock()
+		ahead = !coversExecuted(receive.Executed, r.Executed)
+		r.InstanceMutex.Unlock()
+	}
+	if ahead {
+		go r.sendSnapshot(receive.Address)
+		*reply = true
+	}
+	return nil
+}
+
+//Stream our latest snapshot on disk to 'address' in chunks
+func (r *Replica) sendSnapshot(address Address) {
+	if address.String() == r.Self.String() {
+		return
+	}
+	r.SendingMutex.Lock()
+	if r.Sending[address.String()] {
+		r.SendingMutex.Unlock()
+		return
+	}
+	r.Sending[address.String()] = true
+	r.SendingMutex.Unlock()
+	defer func() {
+		r.SendingMutex.Lock()
+		delete(r.Sending, address.String())
+		r.SendingMutex.Unlock()
+	}()
+
+	path := SnapshotPath(*datadir, r.Self)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("SendSnapshot: Unable to read snapshot:", err)
+		return
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		log.Println("SendSnapshot: Unable to decode snapshot:", err)
+		return
+	}
+
+	chatf(1, "SendSnapshot: Sending snapshot through slot %d (%d bytes) to %s", snap.Slot, len(data), address.String())
+	for offset := 0; offset < len(data) || offset == 0; offset += SnapshotChunk {
+		end := offset + SnapshotChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		send := InstallSnapshotReq{Slot: snap.Slot, Offset: offset, Data: data[offset:end], Done: end == len(data)}
+		recv := InstallSnapshotResp{}
+		RandLatency()
+		if err := Call(address.String(), "Replica.InstallSnapshot", send, &recv); err != nil {
+			chatf(1, "SendSnapshot: Unable to reach %s: %v", address.String(), err)
+			return
+		}
+		RandLatency()
+		if !recv.Okay {
+			chatf(1, "SendSnapshot: %s stopped the transfer at offset %d (applied through slot %d)", address.String(), offset, recv.Applied)
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//--- Multi-key transactions ---//
+
+/*   A transaction is one command, decided in one slot, so the learner applies it all at
+     once and no other command can come in between its parts:
+
+txn [if <guard>...] then <op>... [else <op>...]
+    guard: <key> == <value> | <key> != <value>
+    op:    put <key> <value> | get <key> | delete <key>
+
+    If every guard holds, the 'then' ops run in order, otherwise the 'else' ops do. A key
+    that is not in the database is not equal to any value. Reads see the writes made
+    before them in the same transaction.
+
+    EPaxos commits commands on a single key outside the slot log, so nothing would order a
+    transaction against them. Transactions are refused under -epaxos.
+*/
+
+type Guard struct {
+	Key   string
+	Op    string //"==" or "!="
+	Value string
+}
+
+type TxnOp struct {
+	Op    string //"put", "get" or "delete"
+	Key   string
+	Value string
+}
+
+type Txn struct {
+	Guards []Guard
+	Then   []TxnOp
+	Else   []TxnOp
+}
+
+//Parse the tokens of a txn command, starting with "txn"
+func ParseTxn(tokens []string) (Txn, error) {
+	txn := Txn{}
+	if len(tokens) == 0 || tokens[0] != "txn" {
+		return txn, fmt.Errorf("transaction must start with \"txn\"")
+	}
+	i := 1
+	if i < len(tokens) && tokens[i] == "if" {
+		i++
+		for i < len(tokens) && tokens[i] != "then" {
+			if i+3 > len(tokens) {
+				return txn, fmt.Errorf("guard \"%s\" is not of the form <key> == <value> or <key> != <value>", strings.Join(tokens[i:], " "))
+			}
+			guard := Guard{Key: tokens[i], Op: tokens[i+1], Value: tokens[i+2]}
+			if guard.Op != "==" && guard.Op != "!=" {
+				return txn, fmt.Errorf("guard \"%s\" compares with \"%s\", not == or !=", strings.Join(tokens[i:i+3], " "), guard.Op)
+			}
+			txn.Guards = append(txn.Guards, guard)
+			i += 3
+		}
+	}
+	if i >= len(tokens) || tokens[i] != "then" {
+		return txn, fmt.Errorf("transaction has no \"then\"")
+	}
+	i++
+	var err error
+	txn.Then, i, err = parseTxnOps(tokens, i)
+	if err != nil {
+		return txn, err
+	}
+	if i < len(tokens) {
+		//parseTxnOps only stops early at "else"
+		txn.Else, i, err = parseTxnOps(tokens, i+1)
+		if err != nil {
+			return txn, err
+		}
+	}
+	if len(txn.Then) == 0 && len(txn.Else) == 0 {
+		return txn, fmt.Errorf("transaction does nothing")
+	}
+	return txn, nil
+}
+
+//Parse ops from tokens[i] up to the end or an "else". Returns the ops and where it stopped.
+func parseTxnOps(tokens []string, i int) ([]TxnOp, int, error) {
+	var ops []TxnOp
+	for i < len(tokens) && tokens[i] != "else" {
+		op := TxnOp{Op: tokens[i]}
+		if op.Op == "put" {
+			if i+3 > len(tokens) {
+				return nil, i, fmt.Errorf("usage: put <key> <value>")
+			}
+			op.Key = tokens[i+1]
+			op.Value = tokens[i+2]
+			i += 3
+		} else if op.Op == "get" || op.Op == "delete" {
+			if i+2 > len(tokens) {
+				return nil, i, fmt.Errorf("usage: %s <key>", op.Op)
+			}
+			op.Key = tokens[i+1]
+			i += 2
+		} else {
+			return nil, i, fmt.Errorf("\"%s\" is not put, get or delete", op.Op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, i, nil
+}
+
+//Evaluate the guards of 'txn', decided in slot 'index', and apply the branch they pick.
+//Must hold ApplyMutex.
+func (r *Replica) applyTxn(index int, txn Txn) string {
+	succeeded := true
+	for _, guard := range txn.Guards {
+		dBaseVal, ok := r.Database[guard.Key]
+		equal := ok && dBaseVal == guard.Value
+		if equal != (guard.Op == "==") {
+			succeeded = false
+			break
+		}
+	}
+	ops := txn.Then
+	commandResponse := "txn succeeded"
+	if !succeeded {
+		ops = txn.Else
+		commandResponse = "txn failed"
+	}
+	for _, op := range ops {
+		if op.Op == "put" {
+			r.setKey(index, op.Key, op.Value)
+			commandResponse += "\n[" + op.Key + "] => " + op.Value + " added to database"
+		} else if op.Op == "get" {
+			commandResponse += "\n[" + op.Key + "] => " + r.Database[op.Key]
+		} else if op.Op == "delete" {
+			dBaseVal := r.Database[op.Key]
+			r.deleteKey(index, op.Key)
+			commandResponse += "\n[" + op.Key + "] => " + dBaseVal + " deleted from database"
+		}
+	}
+	return commandResponse
+}
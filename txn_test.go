@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyTxn(t *testing.T) {
+	tests := []struct {
+		name         string
+		database     map[string]string
+		command      string
+		wantResponse string
+		wantDB       map[string]string
+	}{
+		{
+			name:         "txn with no guards",
+			database:     map[string]string{},
+			command:      "txn then put a 1 put b 2",
+			wantResponse: "txn succeeded\n[a] => 1 added to database\n[b] => 2 added to database",
+			wantDB:       map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name:         "txn whose guards hold",
+			database:     map[string]string{"a": "1", "b": "2"},
+			command:      "txn if a == 1 b != 3 then delete a put b 3 else put c 1",
+			wantResponse: "txn succeeded\n[a] => 1 deleted from database\n[b] => 3 added to database",
+			wantDB:       map[string]string{"b": "3"},
+		},
+		{
+			name:         "txn whose guard fails runs else",
+			database:     map[string]string{"a": "1"},
+			command:      "txn if a == 2 then put a 3 else get a put c 1",
+			wantResponse: "txn failed\n[a] => 1\n[c] => 1 added to database",
+			wantDB:       map[string]string{"a": "1", "c": "1"},
+		},
+		{
+			name:         "missing key is not equal to any value",
+			database:     map[string]string{},
+			command:      "txn if a != 1 then put a 1",
+			wantResponse: "txn succeeded\n[a] => 1 added to database",
+			wantDB:       map[string]string{"a": "1"},
+		},
+		{
+			name:         "reads see earlier writes in the same txn",
+			database:     map[string]string{},
+			command:      "txn then put a 1 get a",
+			wantResponse: "txn succeeded\n[a] => 1 added to database\n[a] => 1",
+			wantDB:       map[string]string{"a": "1"},
+		},
+		{
+			name:         "malformed txn changes nothing",
+			database:     map[string]string{"a": "1"},
+			command:      "txn if a = 1 then put a 2",
+			wantResponse: "txn rejected: guard \"a = 1\" compares with \"=\", not == or !=",
+			wantDB:       map[string]string{"a": "1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReplica(t, t.TempDir())
+			r.ApplyMutex.Lock()
+			defer r.ApplyMutex.Unlock()
+			for key, value := range test.database {
+				r.setKey(0, key, value)
+			}
+			if got := r.apply(1, Command{Command: test.command}); got != test.wantResponse {
+				t.Errorf("got response %q, want %q", got, test.wantResponse)
+			}
+			if !reflect.DeepEqual(r.Database, test.wantDB) {
+				t.Errorf("database is %v, want %v", r.Database, test.wantDB)
+			}
+		})
+	}
+}
+
+func TestParseTxnErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+	}{
+		{"no then", []string{"txn", "put", "a", "1"}},
+		{"guard cut short", []string{"txn", "if", "a", "=="}},
+		{"unknown op", []string{"txn", "then", "cas", "a", "1", "2"}},
+		{"put without a value", []string{"txn", "then", "put", "a"}},
+		{"empty branches", []string{"txn", "then", "else"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseTxn(test.command); err == nil {
+				t.Errorf("ParseTxn(%q) succeeded, want an error", test.command)
+			}
+		})
+	}
+}
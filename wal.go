@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//--- Write-ahead log for acceptor and learner state ---//
+
+//Kinds of entries written to the log
+const (
+	LogPromise    = "promise"
+	LogAccept     = "accept"
+	LogDecide     = "decide"
+	LogBallot     = "ballot"     //Promise covering every slot from Slot on
+	LogFastAccept = "fastaccept" //Accepted in the fast round, which has no sequence
+	LogInstance   = "instance"   //State of an EPaxos instance, which has no slot
+	LogOwned      = "owned"      //Mencius: the owner is about to propose on Slot
+)
+
+type LogEntry struct {
+	Kind     string
+	Slot     int
+	Sequence Sequence
+	Command  Command
+	Instance *Instance `json:",omitempty"`
+}
+
+type WAL struct {
+	Path  string
+	File  *os.File
+	Size  int64 //Bytes currently in the log
+	Mutex sync.Mutex
+}
+
+//Name of the log file for the replica listening on 'address'
+func WALPath(dir string, address Address) string {
+	return filepath.Join(dir, "paxos-"+address.IP+"-"+address.Port+".wal")
+}
+
+//Open the log at 'path', creating it if needed, and return every entry already written to it
+func OpenWAL(path string) (*WAL, []LogEntry, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []LogEntry
+	var offset int64
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			//Append writes an entry and its newline together, so a last line without its
+			//newline was cut off by a crash mid-write - drop it
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		var entry LogEntry
+		//A partially written entry at the tail means we crashed mid-write - drop it
+		if err := json.Unmarshal(line, &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+		offset += int64(len(line))
+	}
+	//Cut off anything after the last good entry so new entries are not appended after garbage
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &WAL{Path: path, File: file, Size: offset}, entries, nil
+}
+
+//Write 'entry' to the end of the log and fsync it before returning
+func (w *WAL) Append(entry LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if _, err := w.File.Write(data); err != nil {
+		return err
+	}
+	w.Size += int64(len(data))
+	return w.File.Sync()
+}
+
+//Bytes currently in the log
+func (w *WAL) Len() int64 {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return w.Size
+}
+
+//Atomically replace the contents of the log with the entries returned by 'entries'.
+//'entries' is called with the log locked so no concurrent Append can be lost in between.
+func (w *WAL) Rewrite(entries func() []LogEntry) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	tmp := w.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries() {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+		size += int64(len(data)) + 1
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, w.Path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(w.Path)); err != nil {
+		return err
+	}
+
+	//Reopen for appending so later entries land in the new file
+	file, err = os.OpenFile(w.Path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.File.Close()
+	w.File = file
+	w.Size = size
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return w.File.Close()
+}
+
+//Persist 'entry' before the caller is allowed to act on it. An acceptor that cannot
+//remember what it promised must not keep participating, so failures are fatal.
+func (r *Replica) persist(entry LogEntry) {
+	if r.WAL == nil {
+		return
+	}
+	if err := r.WAL.Append(entry); err != nil {
+		log.Fatalf("Persist: failed to write %s for slot %d to %s: %v", entry.Kind, entry.Slot, r.WAL.Path, err)
+	}
+}
+
+//Rebuild slot state from log entries, then re-apply decided commands to the database in slot order
+func (r *Replica) replay(entries []LogEntry) {
+	for _, entry := range entries {
+		if entry.Kind == LogBallot {
+			r.Ballot = entry.Sequence
+			r.BallotFrom = entry.Slot
+			continue
+		}
+		if entry.Kind == LogInstance {
+			r.replayInstance(entry.Instance)
+			continue
+		}
+		if entry.Kind == LogOwned {
+			if entry.Slot > r.Owned {
+				r.Owned = entry.Slot
+			}
+			continue
+		}
+		//Already reflected in the snapshot
+		if entry.Slot < r.Base {
+			continue
+		}
+		r.getSlots(entry.Slot)
+		slot := r.slot(entry.Slot)
+		//A rewritten log has the promise before the accept, so only ever raise Sequence
+		if entry.Kind == LogPromise {
+			if entry.Sequence.Cmp(slot.Sequence) > 0 {
+				slot.Sequence = entry.Sequence
+			}
+		} else if entry.Kind == LogAccept {
+			if entry.Sequence.Cmp(slot.Sequence) > 0 {
+				slot.Sequence = entry.Sequence
+			}
+			slot.AcceptedSeq = entry.Sequence
+			slot.Command = entry.Command
+			slot.Accepted = true
+			slot.Fast = false
+		} else if entry.Kind == LogFastAccept {
+			slot.Command = entry.Command
+			slot.Accepted = true
+			slot.Fast = true
+		} else if entry.Kind == LogDecide {
+			slot.Command = entry.Command
+			slot.Decided = true
+		}
+	}
+	r.applyDecided()
+	r.executeInstances()
+	chatf(1, "Replay: Restored %d slots from %d log entries", len(r.Slots), len(entries))
+}
+
+//Log entries that reproduce the current state of every slot and EPaxos instance still
+//held in memory. Must hold the Mutex write lock.
+func (r *Replica) slotEntries() []LogEntry {
+	var entries []LogEntry
+	if r.Ballot.N > 0 {
+		entries = append(entries, LogEntry{Kind: LogBallot, Slot: r.BallotFrom, Sequence: r.Ballot})
+	}
+	if r.Owned >= 0 {
+		entries = append(entries, LogEntry{Kind: LogOwned, Slot: r.Owned})
+	}
+	for _, slot := range r.Slots {
+		if slot.Sequence.N > 0 {
+			entries = append(entries, LogEntry{Kind: LogPromise, Slot: slot.Index, Sequence: slot.Sequence})
+		}
+		if slot.Accepted && slot.Fast {
+			entries = append(entries, LogEntry{Kind: LogFastAccept, Slot: slot.Index, Command: slot.Command})
+		} else if slot.Accepted {
+			entries = append(entries, LogEntry{Kind: LogAccept, Slot: slot.Index, Sequence: slot.AcceptedSeq, Command: slot.Command})
+		}
+		if slot.Decided {
+			entries = append(entries, LogEntry{Kind: LogDecide, Slot: slot.Index, Command: slot.Command})
+		}
+	}
+	return append(entries, r.instanceEntries()...)
+}
+
+//fsync a directory so that a rename inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
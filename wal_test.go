@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpenWALDropsTornTail(t *testing.T) {
+	complete := `{"Kind":"decide","Slot":0,"Command":{"Command":"put a 1"}}` + "\n"
+	tests := []struct {
+		name        string
+		contents    string
+		wantEntries int
+	}{
+		{"empty", "", 0},
+		{"complete entries", complete + complete, 2},
+		{"entry cut off mid-write", complete + `{"Kind":"dec`, 1},
+		{"entry missing its newline", complete + `{"Kind":"decide","Slot":1}`, 1},
+		{"garbage after a good entry", complete + "not json\n" + complete, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.wal")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wal, entries, err := OpenWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			if len(entries) != test.wantEntries {
+				t.Errorf("got %d entries, want %d", len(entries), test.wantEntries)
+			}
+			//Whatever was dropped is cut off so new entries follow the last good one
+			if err := wal.Append(LogEntry{Kind: LogDecide, Slot: 5}); err != nil {
+				t.Fatal(err)
+			}
+			wal.Close()
+			wal, entries, err = OpenWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantEntries+1 || entries[len(entries)-1].Slot != 5 {
+				t.Errorf("after appending got %v, want %d entries ending in slot 5", entries, test.wantEntries+1)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	decide := func(slot int, command string) LogEntry {
+		return LogEntry{Kind: LogDecide, Slot: slot, Command: Command{Command: command, Tag: slot + 1}}
+	}
+	tests := []struct {
+		name        string
+		before      []LogEntry
+		snapshot    bool //Restart, snapshot, then log 'after'
+		after       []LogEntry
+		wantDB      map[string]string
+		wantApplied int
+		wantBase    int
+	}{
+		{
+			name:        "decided slots are applied in order",
+			before:      []LogEntry{decide(1, "put a 2"), decide(0, "put a 1")},
+			wantDB:      map[string]string{"a": "2"},
+			wantApplied: 1,
+		},
+		{
+			name:        "a missing slot holds up the ones after it",
+			before:      []LogEntry{decide(0, "put a 1"), decide(2, "put b 2")},
+			wantDB:      map[string]string{"a": "1"},
+			wantApplied: 0,
+		},
+		{
+			name:        "accepted but undecided values are not applied",
+			before:      []LogEntry{{Kind: LogAccept, Slot: 0, Sequence: Sequence{N: 2}, Command: Command{Command: "put a 1"}}},
+			wantDB:      map[string]string{},
+			wantApplied: -1,
+		},
+		{
+			name:        "snapshot and the log after it",
+			before:      []LogEntry{decide(0, "put a 1"), decide(1, "delete a")},
+			snapshot:    true,
+			after:       []LogEntry{decide(2, "put b 2")},
+			wantDB:      map[string]string{"b": "2"},
+			wantApplied: 2,
+			wantBase:    2,
+		},
+		{
+			name:        "entries already in the snapshot are skipped",
+			before:      []LogEntry{decide(0, "put a 1")},
+			snapshot:    true,
+			after:       []LogEntry{decide(0, "put a 1"), decide(1, "put a 3")},
+			wantDB:      map[string]string{"a": "3"},
+			wantApplied: 1,
+			wantBase:    1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := newTestReplica(t, dir)
+			for _, entry := range test.before {
+				r.persist(entry)
+			}
+			if test.snapshot {
+				r.WAL.Close()
+				r = newTestReplica(t, dir)
+				r.ApplyMutex.Lock()
+				r.takeSnapshot()
+				r.ApplyMutex.Unlock()
+				for _, entry := range test.after {
+					r.persist(entry)
+				}
+			}
+			r.WAL.Close()
+
+			r = newTestReplica(t, dir)
+			if !reflect.DeepEqual(r.Database, test.wantDB) {
+				t.Errorf("database is %v, want %v", r.Database, test.wantDB)
+			}
+			if r.Applied != test.wantApplied {
+				t.Errorf("applied through slot %d, want %d", r.Applied, test.wantApplied)
+			}
+			if r.Base != test.wantBase {
+				t.Errorf("base is %d, want %d", r.Base, test.wantBase)
+			}
+		})
+	}
+}
+
+func TestReplayKeepsHighestPromise(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []LogEntry
+		wantPromised int
+		wantAccepted int
+	}{
+		{
+			name: "promise then accept at that ballot",
+			entries: []LogEntry{
+				{Kind: LogPromise, Slot: 0, Sequence: Sequence{N: 2}},
+				{Kind: LogAccept, Slot: 0, Sequence: Sequence{N: 2}, Command: Command{Command: "put a 1"}},
+			},
+			wantPromised: 2,
+			wantAccepted: 2,
+		},
+		{
+			name: "rewritten log puts the later promise before the accept",
+			entries: []LogEntry{
+				{Kind: LogPromise, Slot: 0, Sequence: Sequence{N: 3}},
+				{Kind: LogAccept, Slot: 0, Sequence: Sequence{N: 2}, Command: Command{Command: "put a 1"}},
+			},
+			wantPromised: 3,
+			wantAccepted: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := newTestReplica(t, dir)
+			for _, entry := range test.entries {
+				r.persist(entry)
+			}
+			r.WAL.Close()
+
+			r = newTestReplica(t, dir)
+			slot := r.slotCopy(0)
+			if slot.Sequence.N != test.wantPromised {
+				t.Errorf("promised %d, want %d", slot.Sequence.N, test.wantPromised)
+			}
+			if !slot.Accepted || slot.AcceptedSeq.N != test.wantAccepted {
+				t.Errorf("accepted %t at %d, want true at %d", slot.Accepted, slot.AcceptedSeq.N, test.wantAccepted)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//--- Watching keys for changes ---//
+
+/*   Every write the learner applies is also recorded as a change, stamped with the slot it
+     was decided in. Watch long-polls: it returns the changes to a key or prefix at or after
+     a slot, waiting for one if there are none yet, along with the slot to resume from next
+     time. A watcher that reconnects with that slot misses nothing, unless the changes it
+     asks for have been dropped to make room, in which case it is told so and has to re-read
+     the keys it cares about.
+
+     EPaxos commands are not decided in slots, so there is no slot to resume a watch from.
+     Their changes are not recorded and watch is refused under -epaxos.
+*/
+
+//Most changes kept for watchers. The oldest are dropped first.
+const MaxChanges = 10000
+
+//Longest a Watch call waits for a change before returning with none
+const WatchTimeout = 10 * time.Second
+
+//How long a watcher waits before calling again after a failed or refused Watch
+const WatchRetryDelay = 1 * time.Second
+
+type Change struct {
+	Slot    int //Slot of the command that made the change
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+//Record a change to the database and wake up any watchers. Must hold ApplyMutex.
+func (r *Replica) changed(change Change) {
+	//Made by an EPaxos instance, which has no slot
+	if change.Slot < 0 {
+		return
+	}
+	r.Changes = append(r.Changes, change)
+	if len(r.Changes) > MaxChanges {
+		r.ChangesFrom = r.Changes[0].Slot + 1
+		r.Changes = r.Changes[1:]
+	}
+	close(r.ChangeSignal)
+	r.ChangeSignal = make(chan Nothing)
+}
+
+//Forget every change recorded so far, after a snapshot replaced the database. Watchers
+//that have not seen slot 'slot' yet have missed changes. Must hold ApplyMutex.
+func (r *Replica) resetChanges(slot int) {
+	r.Changes = nil
+	r.ChangesFrom = slot + 1
+	close(r.ChangeSignal)
+	r.ChangeSignal = make(chan Nothing)
+}
+
+type WatchReq struct {
+	Key    string
+	Prefix bool //Watch every key that starts with Key
+	From   int  //First slot to report changes from, -1 for changes from now on
+}
+type WatchResp struct {
+	Okay      bool
+	Compacted bool //Changes from 'From' on are no longer kept
+	Changes   []Change
+	Next      int //Slot to ask for changes from next time
+}
+
+// Watch(key, prefix, from) -> (okay, compacted, changes, next):
+func (r *Replica) Watch(receive WatchReq, reply *WatchResp) error {
+	if *epaxos {
+		reply.Okay = false
+		return nil
+	}
+	timeout := time.After(WatchTimeout)
+	for {
+		r.ApplyMutex.Lock()
+		if receive.From < 0 {
+			receive.From = r.Applied + 1
+		}
+		if receive.From < r.ChangesFrom {
+			chatf(1, "Watch: Changes from slot %d are no longer kept", receive.From)
+			reply.Okay = false
+			reply.Compacted = true
+			reply.Next = r.Applied + 1
+			r.ApplyMutex.Unlock()
+			return nil
+		}
+		for _, change := range r.Changes {
+			if change.Slot < receive.From {
+				continue
+			}
+			if change.Key == receive.Key || (receive.Prefix && strings.HasPrefix(change.Key, receive.Key)) {
+				reply.Changes = append(reply.Changes, change)
+			}
+		}
+		reply.Next = r.Applied + 1
+		signal := r.ChangeSignal
+		r.ApplyMutex.Unlock()
+
+		if len(reply.Changes) > 0 {
+			reply.Okay = true
+			return nil
+		}
+		select {
+		case <-signal:
+		case <-timeout:
+			reply.Okay = true
+			return nil
+		}
+	}
+}
+
+//Print every change to 'key' (or every key starting with it if 'prefix') from slot 'from'
+//on, until the program exits
+func watch(replica *Replica, key string, prefix bool, from int) {
+	name := key
+	if prefix {
+		name += "*"
+	}
+	for {
+		send := WatchReq{Key: key, Prefix: prefix, From: from}
+		reply := WatchResp{}
+		err := Call(replica.Self.String(), "Replica.Watch", send, &reply)
+		//Keep the slot to resume from and try again in a while
+		if err != nil || (!reply.Okay && !reply.Compacted) {
+			time.Sleep(WatchRetryDelay)
+			continue
+		}
+		if reply.Compacted {
+			fmt.Printf("watch %s: changes from slot %d are no longer kept, resuming from slot %d\n", name, from, reply.Next)
+		}
+		for _, change := range reply.Changes {
+			if change.Deleted {
+				fmt.Printf("watch %s: [%s] deleted (slot %d)\n", name, change.Key, change.Slot)
+			} else {
+				fmt.Printf("watch %s: [%s] => %s (slot %d)\n", name, change.Key, change.Value, change.Slot)
+			}
+		}
+		from = reply.Next
+	}
+}